@@ -4,19 +4,30 @@ go 1.15
 
 require (
 	cloud.google.com/go/storage v1.25.0
+	filippo.io/age v1.0.0
 	github.com/aws/aws-sdk-go-v2 v1.16.11
 	github.com/aws/aws-sdk-go-v2/config v1.17.0
+	github.com/aws/aws-sdk-go-v2/credentials v1.12.13
+	github.com/aws/aws-sdk-go-v2/feature/s3/manager v1.11.25
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.27.5
+	github.com/fsnotify/fsnotify v1.5.4
 	github.com/go-enry/go-enry/v2 v2.8.2 // indirect
 	github.com/gorhill/cronexpr v0.0.0-20180427100037-88b0669f7d75
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
 	github.com/jessevdk/go-flags v1.5.0 // indirect
+	github.com/johannesboyne/gofakes3 v0.0.0-20220627085814-c3ac35da23b2
 	github.com/joho/godotenv v1.4.0
+	github.com/klauspost/compress v1.15.0
+	github.com/mattn/go-sqlite3 v1.14.14
+	github.com/mitchellh/mapstructure v1.5.0
+	github.com/pkg/sftp v1.13.5
 	github.com/robfig/cron/v3 v3.0.0
 	github.com/sirupsen/logrus v1.9.0
-	github.com/spf13/cobra v1.5.0 // indirect
+	github.com/spf13/cobra v1.5.0
 	github.com/spf13/viper v1.12.0
+	github.com/ulikunitz/xz v0.5.10
+	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4
 	golang.org/x/net v0.0.0-20220812174116-3211cb980234 // indirect
-	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab // indirect
+	golang.org/x/sys v0.0.0-20220811171246-fbc7d0a398ab
 	google.golang.org/api v0.88.0
 )
@@ -2,64 +2,322 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"hash"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
-func addFileToArchive(f string, t *BackupTarget, tw *tar.Writer) {
-	fileHandle, err := os.Open(f)
-	handleFatalErr(err, "Cannot open file")
-	info, err := fileHandle.Stat()
-	handleFatalErr(err, "Cannot stat file")
-	header, err := tar.FileInfoHeader(info, info.Name())
+// getArchiveEntryName returns the path of a file in archives, relative to its
+// target path and below the prefix of that path
+func getArchiveEntryName(t *BackupTarget, f string) string {
+	source := getBackupSource(t, f)
+	if source == nil {
+		return filepath.ToSlash(f)
+	}
+	rel, err := filepath.Rel(source.Path, f)
+	if err != nil {
+		return filepath.ToSlash(f)
+	}
 	if t.Config.PreserveAbsoluteHierarchy {
-		header.Name = f
-	} else {
-		header.Name = strings.ReplaceAll(f, t.Config.Path, "")
-		if header.Name[0] == '/' {
-			header.Name = header.Name[1:]
+		return filepath.Join(source.originalPath(), rel)
+	}
+	if rel == "." {
+		// The target path is a single file
+		if len(source.Prefix) > 0 {
+			return source.Prefix
+		}
+		rel = filepath.Base(f)
+	}
+	return path.Join(source.Prefix, filepath.ToSlash(rel))
+}
+
+// fileId identifies a file across its hard links
+type fileId struct {
+	dev uint64
+	ino uint64
+}
+
+// xattrPaxPrefix is the PAX record prefix of extended attributes, as written by GNU tar
+const xattrPaxPrefix = "SCHILY.xattr."
+
+func addXattrsToHeader(t *BackupTarget, f string, header *tar.Header) {
+	xattrs, err := getXattrs(f)
+	if handleWarnErr(err, "[%s] Cannot read extended attributes of %s", t.Name, f) || len(xattrs) == 0 {
+		return
+	}
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string, len(xattrs))
+	}
+	for name, value := range xattrs {
+		header.PAXRecords[xattrPaxPrefix+name] = value
+	}
+	header.Format = tar.FormatPAX
+}
+
+// sizedReader reads exactly size bytes, cutting the content of a file that grew
+// and padding with zeros the one of a file that shrank, so that the size
+// written in its archive header stays right
+type sizedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		for i := n; i < len(p); i++ {
+			p[i] = 0
+		}
+		n, err = len(p), nil
+	}
+	s.remaining -= int64(n)
+	return n, err
+}
+
+// hasFileChanged reports whether an open file was modified since info was taken
+func hasFileChanged(file *os.File, info os.FileInfo) bool {
+	current, err := file.Stat()
+	return err == nil && (current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()))
+}
+
+func reportChangedFile(t *BackupTarget, f string, result *BackupRunResult) {
+	log.Warnf("[%s] File %s changed while being backed up\n", t.Name, f)
+	result.ChangedFiles++
+}
+
+// checkChangedFiles fails the run if files changed while being backed up and
+// 'fail_on_change' is set
+func checkChangedFiles(t *BackupTarget, result *BackupRunResult) error {
+	if t.Config.FailOnChange && result.ChangedFiles > 0 {
+		return fmt.Errorf("%d file(s) changed while being backed up", result.ChangedFiles)
+	}
+	return nil
+}
+
+// addFileToArchive adds any kind of file without following symlinks. The second
+// path of a file with several hard links is stored as a link to the first one,
+// unless hardLinks is nil. It returns false without error when the file vanished
+// or cannot be read anymore, since nothing was written to the archive yet.
+func addFileToArchive(f string, name string, t *BackupTarget, aw archiveWriter, hardLinks map[fileId]string, result *BackupRunResult) (bool, error) {
+	info, err := os.Lstat(f)
+	if err != nil {
+		log.Warnf("[%s] Skipping file: %s\n", t.Name, err.Error())
+		return false, nil
+	}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(f); err != nil {
+			log.Warnf("[%s] Skipping file: %s\n", t.Name, err.Error())
+			return false, nil
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		// Sockets cannot be archived
+		log.Warnf("[%s] Skipping file %s: %s\n", t.Name, f, err.Error())
+		return false, nil
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name = strings.TrimSuffix(name, "/") + "/"
+	}
+	if t.Config.PreserveXattrs {
+		addXattrsToHeader(t, f, header)
+	}
+	if header.Typeflag == tar.TypeReg && hardLinks != nil {
+		if id, links, ok := getFileId(info); ok && links > 1 {
+			if target, ok := hardLinks[id]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = target
+				header.Size = 0
+			} else {
+				hardLinks[id] = header.Name
+			}
+		}
+	}
+	if header.Typeflag != tar.TypeReg {
+		if err := aw.writeEntry(header, nil); err != nil {
+			return false, fmt.Errorf("cannot add file %s: %w", f, err)
+		}
+		return true, nil
+	}
+
+	fileHandle, err := os.Open(f)
+	if err != nil {
+		log.Warnf("[%s] Skipping file: %s\n", t.Name, err.Error())
+		return false, nil
+	}
+	defer fileHandle.Close()
+	if info, err = fileHandle.Stat(); err != nil {
+		log.Warnf("[%s] Skipping file: %s\n", t.Name, err.Error())
+		return false, nil
+	}
+	header.Size = info.Size()
+	header.ModTime = info.ModTime()
+	var content io.Reader = &sizedReader{r: fileHandle, remaining: header.Size}
+	var hasher hash.Hash
+	if t.Manifest != nil {
+		hasher = sha256.New()
+		content = io.TeeReader(content, hasher)
+	}
+	if err := aw.writeEntry(header, content); err != nil {
+		return false, fmt.Errorf("cannot add file %s: %w", f, err)
+	}
+	if hasFileChanged(fileHandle, info) {
+		reportChangedFile(t, f, result)
+	}
+	if hasher != nil {
+		if entry, ok := t.Manifest.Files[header.Name]; ok {
+			entry.Hash = hex.EncodeToString(hasher.Sum(nil))
 		}
 	}
-	handleFatalErr(tw.WriteHeader(header))
-	_, err = io.Copy(tw, fileHandle)
-	handleFatalErr(err, "Cannot copy content from file")
-	handleFatalErr(fileHandle.Close(), "Cannot close file")
 	//log.Debugf("Adding file %s to archive\n", header.Name)
+	return true, nil
 }
 
 func getArchiveExt(t *BackupTarget) string {
-	log.Warnln(t.Config.Format)
-	switch t.Config.Format {
-	case "tar.gz", "compressed":
-		return ".tar.gz"
-	default:
+	if t.Config.Type == repositoryTargetType {
+		return repositorySnapshotExt
+	}
+	format, err := getArchiveFormat(t.Config.Format)
+	if err != nil {
 		return ".unknown"
 	}
+	ext := format.Ext
+	if isRawCommandTarget(t) {
+		ext = format.RawExt
+	}
+	if t.Config.Encryption.enabled() {
+		return ext + encryptedArchiveExt
+	}
+	return ext
 }
 
-func buildArchive(t *BackupTarget) {
-	archiveBasepath := filepath.Join(t.TmpWorkdir, t.Name)
+func getArchiveName(t *BackupTarget, date time.Time) string {
+	name := t.Name
 	if t.Config.DateSuffix {
-		archiveBasepath += "_" + time.Now().Format("02012006_150405")
+		name += "_" + date.Format("02012006_150405")
 	}
-	t.Archive = archiveBasepath + t.Ext
-	fileWriter, err := os.Create(t.Archive)
-	handleFatalErr(err, "Error when creating file")
-	defer func() { handleFatalErr(fileWriter.Close(), "Error when closing file writer") }()
+	if t.Manifest != nil && !t.Manifest.Full {
+		name += incrementalArchiveMarker
+	}
+	return name + t.Ext
+}
 
-	gzipWriter := gzip.NewWriter(fileWriter)
-	defer func() { handleFatalErr(gzipWriter.Close(), "Error when closing gzip writer") }()
+func addManifestToArchive(t *BackupTarget, aw archiveWriter) error {
+	t.Manifest.Archive = getArchiveName(t, t.Manifest.Created)
+	content, err := json.Marshal(t.Manifest)
+	if err != nil {
+		return err
+	}
+	return aw.writeEntry(&tar.Header{
+		Name:     manifestEntryName,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     int64(len(content)),
+		ModTime:  t.Manifest.Created,
+	}, bytes.NewReader(content))
+}
 
-	tarWriter := tar.NewWriter(gzipWriter)
-	defer func() { handleFatalErr(tarWriter.Close(), "Error when closing tar writer") }()
+// writeArchive writes the compressed archive of the target files to w
+func writeArchive(ctx context.Context, t *BackupTarget, w io.Writer, result *BackupRunResult) (err error) {
+	format, err := getArchiveFormat(t.Config.Format)
+	if err != nil {
+		return err
+	}
+	encryptor, err := newArchiveEncryptor(t, w)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt archive: %w", err)
+	}
+	if encryptor != nil {
+		w = encryptor
+		defer func() {
+			// Runs after the archive is finalized, to flush the last encrypted chunk
+			if closeErr := encryptor.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("cannot finalize encrypted archive: %w", closeErr)
+			}
+		}()
+	}
+	if isRawCommandTarget(t) {
+		return writeRawOutput(t, format, w, result)
+	}
+	archiveWriter, err := newArchiveWriter(format, t.Config.CompressionLevel, w)
+	if err != nil {
+		return fmt.Errorf("cannot create %s archive: %w", format.Name, err)
+	}
+	defer func() {
+		// The archive is finalized even after a failure, but only the first error is kept
+		if closeErr := archiveWriter.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("cannot finalize archive: %w", closeErr)
+		}
+	}()
 
+	// Zip archives cannot hold hard links, their content is stored for every path
+	var hardLinks map[fileId]string
+	if !format.zip {
+		hardLinks = make(map[fileId]string)
+	}
 	for _, file := range t.Files {
-		addFileToArchive(file, t, tarWriter)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		added, err := addFileToArchive(file, getArchiveEntryName(t, file), t, archiveWriter, hardLinks, result)
+		if err != nil {
+			return err
+		}
+		if added {
+			result.Files++
+		} else {
+			result.SkippedFiles++
+		}
+	}
+	err = addGitBundles(ctx, t, result, func(bundlePath string, name string) (bool, error) {
+		return addFileToArchive(bundlePath, name, t, archiveWriter, nil, result)
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkChangedFiles(t, result); err != nil {
+		return err
+	}
+	if t.Manifest != nil {
+		if err := addManifestToArchive(t, archiveWriter); err != nil {
+			return fmt.Errorf("cannot add manifest to archive: %w", err)
+		}
+	}
+	return nil
+}
+
+func buildArchive(ctx context.Context, t *BackupTarget, result *BackupRunResult) error {
+	t.Archive = filepath.Join(t.TmpWorkdir, getArchiveName(t, result.Started))
+	fileWriter, err := os.Create(t.Archive)
+	if err != nil {
+		return fmt.Errorf("cannot create archive file: %w", err)
+	}
+	if err := writeArchive(ctx, t, fileWriter, result); err != nil {
+		fileWriter.Close()
+		return err
+	}
+	if err := fileWriter.Close(); err != nil {
+		return fmt.Errorf("cannot finalize archive: %w", err)
 	}
 	log.Infof("[%s] Created archive '%s'\n", t.Name, filepath.Base(t.Archive))
+	return nil
 }
@@ -5,23 +5,36 @@ import (
 	"sort"
 )
 
-func sortBackups(t *BackupTarget, backups []BackupItem) {
-	if len(backups) > 0 {
-		if t.Config.KeepOnly >= len(backups) {
-			return
-		}
-		sort.SliceStable(backups, func(i, j int) bool {
-			return backups[i].Date.Before(backups[j].Date)
-		})
+func sortBackups(backups []BackupItem) {
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Date.Before(backups[j].Date)
+	})
+}
+
+// getBackupsToRemove sorts the backups by date and returns the oldest ones
+// exceeding 'keep_only'
+func getBackupsToRemove(t *BackupTarget, backups []BackupItem) []BackupItem {
+	sortBackups(backups)
+	if t.Config.Incremental {
+		return getIncrementalBackupsToRemove(t, backups)
 	}
+	if len(backups) <= t.Config.KeepOnly {
+		return nil
+	}
+	return backups[:len(backups)-t.Config.KeepOnly]
 }
 
+// doesBackupNameMatch reports whether a file or object name, folders included, is
+// an archive of the target in its current format
 func doesBackupNameMatch(t *BackupTarget, backupName string) bool {
-	reg := t.Name
+	reg := "(^|/)" + regexp.QuoteMeta(t.Name)
 	if t.Config.DateSuffix {
 		reg += "_[0-9]{8}_[0-9]{6}"
 	}
-	reg += t.Ext
-	match, _ := regexp.Match(reg, []byte(backupName))
+	if t.Config.Incremental {
+		reg += "(" + regexp.QuoteMeta(incrementalArchiveMarker) + ")?"
+	}
+	reg += regexp.QuoteMeta(t.Ext) + "$"
+	match, _ := regexp.MatchString(reg, backupName)
 	return match
 }
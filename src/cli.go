@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+type cliOptions struct {
+	configFile string
+	logLevel   string
+	stateFile  string
+}
+
+func newRootCommand() *cobra.Command {
+	opts := &cliOptions{}
+	daemonOpts := &DaemonOptions{}
+
+	rootCmd := &cobra.Command{
+		Use:           "autobackup",
+		Short:         "Scheduled backups of local directories to local and cloud destinations",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return setupCli(opts)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDaemonCommand(opts, *daemonOpts)
+		},
+	}
+	addDaemonFlags(rootCmd, daemonOpts)
+	rootCmd.PersistentFlags().StringVarP(&opts.configFile, "config", "c", "", "path to the configuration file (default $HOME/.config/autobackup/config.toml or ./config.toml)")
+	rootCmd.PersistentFlags().StringVarP(&opts.logLevel, "log-level", "l", "info", "log level (trace, debug, info, warn, error)")
+	rootCmd.PersistentFlags().StringVar(&opts.stateFile, "state-file", getDefaultStateFile(), "path to the file recording the run history of every target")
+
+	rootCmd.AddCommand(
+		newDaemonCommand(opts),
+		newRunCommand(opts),
+		newListCommand(),
+		newRestoreCommand(),
+		newValidateCommand(),
+	)
+	return rootCmd
+}
+
+func setupCli(opts *cliOptions) error {
+	level, err := log.ParseLevel(opts.logLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	log.SetReportCaller(level >= log.DebugLevel)
+
+	if len(opts.configFile) > 0 {
+		viper.SetConfigFile(parseTilde(opts.configFile))
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath("$HOME/.config/autobackup")
+		viper.AddConfigPath(".")
+	}
+	viper.SetConfigType("toml")
+	manifestDir = filepath.Join(filepath.Dir(parseTilde(opts.stateFile)), "manifests")
+	return nil
+}
+
+// findValidBackupTarget returns the target of the given name, rejected as the
+// daemon would if it is invalid
+func findValidBackupTarget(backupTargets []*BackupTarget, name string) (*BackupTarget, error) {
+	for _, t := range backupTargets {
+		if t.Name != name {
+			continue
+		}
+		if err := validateBackupTarget(t); err != nil {
+			return nil, fmt.Errorf("[%s] %w", t.Name, err)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown backup target '%s'", name)
+}
+
+func findBackupDestination(t *BackupTarget, name string) (BackupDestination, error) {
+	for _, d := range getReadyDestinations(t) {
+		if d.getName() == name {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("[%s] no initialized destination named '%s'", t.Name, name)
+}
+
+func addDaemonFlags(cmd *cobra.Command, opts *DaemonOptions) {
+	cmd.Flags().DurationVar(&opts.ShutdownTimeout, "shutdown-timeout", 5*time.Minute, "how long to wait for backups in progress on SIGINT/SIGTERM before cancelling them")
+	cmd.Flags().BoolVar(&opts.WatchConfig, "watch-config", true, "reload the configuration when the configuration file changes")
+}
+
+func newDaemonCommand(cliOpts *cliOptions) *cobra.Command {
+	opts := &DaemonOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Schedule every configured backup target and run until stopped",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDaemonCommand(cliOpts, *opts)
+		},
+	}
+	addDaemonFlags(cmd, opts)
+	return cmd
+}
+
+func runDaemonCommand(cliOpts *cliOptions, opts DaemonOptions) error {
+	backupTargets, err := loadValidBackupTargets()
+	if err != nil {
+		return err
+	}
+	state, err := loadStateStore(parseTilde(cliOpts.stateFile))
+	if err != nil {
+		return err
+	}
+	daemon := NewBackupDaemon(opts, state)
+	if err := daemon.schedule(backupTargets); err != nil {
+		return err
+	}
+	daemon.run()
+	return nil
+}
+
+func newRunCommand(cliOpts *cliOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "run <target>...",
+		Short: "Run the given backup targets immediately",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backupTargets, err := parseConfig()
+			if err != nil {
+				return err
+			}
+			state, err := loadStateStore(parseTilde(cliOpts.stateFile))
+			if err != nil {
+				return err
+			}
+			var selected []*BackupTarget
+			for _, name := range args {
+				t, err := findValidBackupTarget(backupTargets, name)
+				if err != nil {
+					return err
+				}
+				selected = append(selected, t)
+			}
+			if err := validateRepositoryPrefixes(backupTargets); err != nil {
+				return err
+			}
+			ctx, cancel := newSignalContext()
+			defer cancel()
+			var failed int
+			for _, t := range selected {
+				prepareBackupTarget(t)
+				result := processBackupTarget(ctx, t)
+				closeBackupTargetDestinations(t)
+				result.log()
+				handleErr(state.record(result), "[%s] Cannot record run in state file", t.Name)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if result.failed() {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d backup target(s) failed", failed, len(selected))
+			}
+			return nil
+		},
+	}
+}
+
+func newListCommand() *cobra.Command {
+	var destName string
+
+	cmd := &cobra.Command{
+		Use:   "list <target>",
+		Short: "List the backups of a target stored at its destinations",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backupTargets, err := parseConfig()
+			if err != nil {
+				return err
+			}
+			t, err := findValidBackupTarget(backupTargets, args[0])
+			if err != nil {
+				return err
+			}
+			prepareBackupTarget(t)
+			initBackupTargetDestinations(t, false)
+			defer closeBackupTargetDestinations(t)
+			destinations := getReadyDestinations(t)
+			if len(destName) > 0 {
+				d, err := findBackupDestination(t, destName)
+				if err != nil {
+					return err
+				}
+				destinations = []BackupDestination{d}
+			}
+
+			ctx, cancel := newSignalContext()
+			defer cancel()
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "DESTINATION\tDATE\tNAME")
+			for _, d := range destinations {
+				backupItems, err := d.buildBackupsList(ctx)
+				if handleErr(err, getDestLogPrefix(d)) {
+					continue
+				}
+				sortBackups(backupItems)
+				for _, item := range backupItems {
+					fmt.Fprintf(w, "%s\t%s\t%s\n", d.getName(), item.Date.Format(time.RFC3339), item.Name)
+				}
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().StringVarP(&destName, "dest", "d", "", "only list backups stored at this destination")
+	return cmd
+}
+
+func newRestoreCommand() *cobra.Command {
+	var opts RestoreOptions
+
+	cmd := &cobra.Command{
+		Use:   "restore <target>",
+		Short: "Download a backup of a target and extract it",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backupTargets, err := parseConfig()
+			if err != nil {
+				return err
+			}
+			t, err := findValidBackupTarget(backupTargets, args[0])
+			if err != nil {
+				return err
+			}
+			prepareBackupTarget(t)
+			initBackupTargetDestinations(t, false)
+			defer closeBackupTargetDestinations(t)
+			ctx, cancel := newSignalContext()
+			defer cancel()
+			return restoreBackup(ctx, t, opts)
+		},
+	}
+	cmd.Flags().StringVarP(&opts.Destination, "dest", "d", "", "destination to restore from (default the first destination of the target)")
+	cmd.Flags().StringVarP(&opts.Backup, "backup", "b", "", "name of the backup to restore, as shown by 'list' (default the most recent one)")
+	cmd.Flags().StringVarP(&opts.OutputDir, "output", "o", "", "directory to extract the backup into (default the original location)")
+	cmd.Flags().StringSliceVarP(&opts.Paths, "path", "p", nil, "only restore this path of the archive (can be repeated)")
+	cmd.Flags().BoolVar(&opts.Overwrite, "overwrite", false, "overwrite existing files and the metadata of existing directories instead of keeping them")
+	cmd.Flags().StringVarP(&opts.IdentityFile, "identity", "i", "", "age identity file to decrypt encrypted backups (default the passphrase file of the target)")
+	return cmd
+}
+
+func newValidateCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate",
+		Short: "Check the configuration file and the destinations of every target",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			backupTargets, err := parseConfig()
+			if err != nil {
+				return err
+			}
+			var invalid int
+			for _, t := range backupTargets {
+				if err := validateBackupTarget(t); err != nil {
+					log.Errorf("[%s] %s\n", t.Name, err.Error())
+					invalid++
+					continue
+				}
+				prepareBackupTarget(t)
+				failed := initBackupTargetDestinations(t, true)
+				closeBackupTargetDestinations(t)
+				if failed > 0 {
+					log.Errorf("[%s] %d destination(s) failed to initialize\n", t.Name, failed)
+					invalid++
+					continue
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: OK\n", t.Name)
+			}
+			if err := validateRepositoryPrefixes(backupTargets); err != nil {
+				log.Errorln(err.Error())
+				invalid++
+			}
+			if invalid > 0 {
+				return fmt.Errorf("%d invalid backup target(s)", invalid)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// CommandTargetConfig is the command whose standard output is backed up by a
+// command target
+type CommandTargetConfig struct {
+	Run string `mapstructure:"run"`
+	// Entry is the name of the output in archives, the target name by default
+	Entry string `mapstructure:"entry"`
+	// Timeout stops the command if it runs longer, 0 means no limit
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Raw stores the output compressed on its own instead of inside an archive
+	Raw bool `mapstructure:"raw"`
+}
+
+// stringToCommandTargetConfigHook lets 'command' be a plain command instead of a table
+func stringToCommandTargetConfigHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(CommandTargetConfig{}) {
+		return data, nil
+	}
+	return CommandTargetConfig{Run: data.(string)}, nil
+}
+
+func getCommandOutputName(t *BackupTarget) string {
+	if len(t.Config.Command.Entry) > 0 {
+		return t.Config.Command.Entry
+	}
+	return t.Name
+}
+
+func isRawCommandTarget(t *BackupTarget) bool {
+	return t.Config.Type == commandTargetType && t.Config.Command.Raw
+}
+
+func validateCommandTarget(t *BackupTarget) error {
+	if len(t.Config.Path) > 0 || len(t.Config.Paths) > 0 {
+		return fmt.Errorf("command targets do not support 'path' or 'paths'")
+	}
+	if t.Config.GitBundle || t.Config.PreserveAbsoluteHierarchy {
+		return fmt.Errorf("command targets do not support 'git_bundle' or 'preserve_absolute_hierarchy'")
+	}
+	if t.Config.Streaming {
+		return fmt.Errorf("command targets do not support 'streaming', the output being written to a temporary file first")
+	}
+	c := t.Config.Command
+	if len(strings.TrimSpace(c.Run)) == 0 {
+		return fmt.Errorf("missing 'command.run'")
+	}
+	if name := path.Clean(c.Entry); len(c.Entry) > 0 && (strings.Contains(c.Entry, "/") || name == "." || name == "..") {
+		return fmt.Errorf("invalid 'command.entry' '%s'", c.Entry)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("'command.timeout' cannot be negative")
+	}
+	if c.Raw {
+		format, err := getArchiveFormat(t.Config.Format)
+		if err != nil {
+			return err
+		}
+		if len(format.RawExt) == 0 {
+			return fmt.Errorf("format '%s' does not support 'command.raw'", format.Name)
+		}
+		if t.Config.Incremental {
+			return fmt.Errorf("'command.raw' does not support 'incremental'")
+		}
+	}
+	return nil
+}
+
+// runCommandTarget writes the output of the command of a target into its
+// temporary working directory, and makes it the only source of the run
+func runCommandTarget(ctx context.Context, t *BackupTarget) error {
+	name := getCommandOutputName(t)
+	outputPath, err := getDumpPath(t, name)
+	if err != nil {
+		return err
+	}
+	output, err := os.OpenFile(outputPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if t.Config.Command.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Config.Command.Timeout)
+		defer cancel()
+	}
+
+	log.Infof("[%s] Running command '%s'\n", t.Name, t.Config.Command.Run)
+	cmd := newShellCommand(t.Config.Command.Run)
+	cmd.Env = append(os.Environ(), "AUTOBACKUP_TARGET="+t.Name)
+	cmd.Stdout = output
+	err = runSourceCommand(ctx, t, cmd, "command")
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command timed out after %s", t.Config.Command.Timeout)
+	} else if err != nil {
+		return err
+	}
+	if info, err := os.Stat(outputPath); err == nil {
+		log.Infof("[%s] Command wrote %d bytes\n", t.Name, info.Size())
+	}
+	t.Sources = []*BackupSource{{Path: outputPath, Prefix: name}}
+	return nil
+}
+
+// writeRawOutput writes the compressed output of a raw command target to w
+func writeRawOutput(t *BackupTarget, format *ArchiveFormat, w io.Writer, result *BackupRunResult) error {
+	if len(t.Files) != 1 {
+		return fmt.Errorf("missing command output")
+	}
+	output, err := os.Open(t.Files[0])
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	compressor, err := format.newCompressor(w, t.Config.CompressionLevel)
+	if err != nil {
+		return fmt.Errorf("cannot create %s compressor: %w", format.Name, err)
+	}
+	if _, err := io.Copy(compressor, output); err != nil {
+		compressor.Close()
+		return err
+	}
+	if err := compressor.Close(); err != nil {
+		return fmt.Errorf("cannot finalize compressed output: %w", err)
+	}
+	result.Files++
+	return nil
+}
+
+// restoreRawOutput decompresses the output stored by a raw command target and
+// restores it as a file named after its entry
+func restoreRawOutput(t *BackupTarget, item BackupItem, format *ArchiveFormat, r io.Reader, restorer *archiveRestorer) (int, error) {
+	decompressor, err := format.newDecompressor(r)
+	if err != nil {
+		return 0, err
+	}
+	defer decompressor.Close()
+
+	modTime := item.Date
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+	restoredBefore := restorer.count
+	err = restorer.restoreEntry(&tar.Header{
+		Name:     getCommandOutputName(t),
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		ModTime:  modTime,
+	}, decompressor)
+	return restorer.count - restoredBefore, err
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+func newCommand(name string, args ...string) *exec.Cmd {
+	return exec.Command(name, args...)
+}
+
+func newShellCommand(command string) *exec.Cmd {
+	return newCommand("cmd", "/C", command)
+}
+
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
@@ -1,41 +1,165 @@
 package main
 
 import (
+	"fmt"
+	"github.com/mitchellh/mapstructure"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"os/exec"
+	"sort"
 )
 
-func parseConfigDestinations(key string, t *BackupTarget) {
+func parseConfigDestinations(key string, t *BackupTarget) error {
 	for _, destination := range t.Config.Destinations {
 		if parseConfigFn, ok := parseConfigFnMap[destination]; ok {
-			parseConfigFn(key+"."+destination, t)
+			if err := parseConfigFn(key+"."+destination, t); err != nil {
+				return err
+			}
 		} else {
 			log.Warnf("[%s] Unknown backup destination '%s'\n", t.Name, destination)
 			continue
 		}
 		t.DestinationConfig[len(t.DestinationConfig)-1].setTarget(t)
 	}
+	return nil
 }
 
-func parseConfig() []*BackupTarget {
+func parseConfig() ([]*BackupTarget, error) {
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			log.Fatalf("Config file '%s' not found\n", viper.ConfigFileUsed())
-		} else {
-			log.Fatalf("Config file was found but another error was produced : %s\n", err.Error())
+			return nil, fmt.Errorf("config file not found")
 		}
+		return nil, fmt.Errorf("config file was found but another error was produced : %w", err)
 	}
 	log.Infof("Configuration file : '%s'\n", viper.ConfigFileUsed())
 	autobackupConfig := viper.AllSettings()
 
+	keys := make([]string, 0, len(autobackupConfig))
+	for key := range autobackupConfig {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
 	var backupTargets []*BackupTarget
-	for key, _ := range autobackupConfig {
+	for _, key := range keys {
 		backupTarget := new(BackupTarget)
-		handleFatalErr(viper.UnmarshalKey(key, &backupTarget.Config), "unable to decode into struct\n")
+		// VCS metadata was always excluded before 'exclude_vcs' was honored
+		backupTarget.Config.ExcludeVcs = true
+		decodeHook := viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+			stringToBackupSourceHook,
+			stringToHookConfigHook,
+			stringToCommandTargetConfigHook,
+		))
+		if err := viper.UnmarshalKey(key, &backupTarget.Config, decodeHook); err != nil {
+			return nil, fmt.Errorf("[%s] unable to decode backup target: %w", key, err)
+		}
 		backupTarget.Config.Path = parseTilde(backupTarget.Config.Path)
+		backupTarget.Sources = getBackupSources(backupTarget.Config)
 		backupTarget.Name = key
-		parseConfigDestinations(key, backupTarget)
+		if err := parseConfigDestinations(key, backupTarget); err != nil {
+			return nil, fmt.Errorf("[%s] %w", key, err)
+		}
 		backupTargets = append(backupTargets, backupTarget)
 	}
-	return backupTargets
+	return backupTargets, nil
+}
+
+// loadValidBackupTargets parses the configuration and rejects it as a whole if
+// any backup target is invalid
+func loadValidBackupTargets() ([]*BackupTarget, error) {
+	backupTargets, err := parseConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range backupTargets {
+		if err := validateBackupTarget(t); err != nil {
+			return nil, fmt.Errorf("[%s] %w", t.Name, err)
+		}
+	}
+	if err := validateRepositoryPrefixes(backupTargets); err != nil {
+		return nil, err
+	}
+	return backupTargets, nil
+}
+
+func validateBackupTarget(t *BackupTarget) error {
+	switch t.Config.Type {
+	case "", filesTargetType, repositoryTargetType, postgresTargetType, mysqlTargetType, sqliteTargetType, commandTargetType:
+	default:
+		return fmt.Errorf("unknown target type '%s'", t.Config.Type)
+	}
+	var err error
+	switch {
+	case isDatabaseTargetType(t.Config.Type):
+		err = validateDatabaseTarget(t)
+	case t.Config.Type == commandTargetType:
+		err = validateCommandTarget(t)
+	default:
+		err = validateBackupSources(t)
+	}
+	if err != nil {
+		return err
+	}
+	if t.Config.Snapshot.enabled() {
+		if err := validateVolumeSnapshot(t); err != nil {
+			return err
+		}
+	}
+	if _, err := getBackupTargetSchedule(t); err != nil {
+		return err
+	}
+	for _, source := range t.Sources {
+		if _, err := newFileSelector(t, source); err != nil {
+			return err
+		}
+	}
+	if t.Config.GitBundle {
+		if _, err := exec.LookPath("git"); err != nil {
+			return fmt.Errorf("'git_bundle' requires git: %w", err)
+		}
+	}
+	format, err := getArchiveFormat(t.Config.Format)
+	if err != nil {
+		return err
+	}
+	if err := validateCompressionLevel(format, t.Config.CompressionLevel); err != nil {
+		return err
+	}
+	if t.Config.PreserveXattrs && format.zip {
+		return fmt.Errorf("format '%s' does not support 'preserve_xattrs'", format.Name)
+	}
+	if t.Config.Encryption.enabled() {
+		if _, err := getEncryptionRecipients(t.Config.Encryption); err != nil {
+			return err
+		}
+	}
+	if t.Config.Incremental && !t.Config.DateSuffix {
+		return fmt.Errorf("'incremental' requires 'date_suffix'")
+	}
+	if t.Config.FullEvery < 0 {
+		return fmt.Errorf("'full_every' cannot be negative")
+	}
+	if t.Config.Type == repositoryTargetType {
+		if !t.Config.DateSuffix {
+			return fmt.Errorf("repository targets require 'date_suffix'")
+		}
+		if t.Config.Incremental || t.Config.Streaming || t.Config.Encryption.enabled() {
+			return fmt.Errorf("repository targets do not support 'incremental', 'streaming' or 'encryption'")
+		}
+	}
+	for setting, hooks := range map[string][]HookConfig{
+		"pre_hooks":        t.Config.PreHooks,
+		"post_hooks":       t.Config.PostHooks,
+		"on_failure_hooks": t.Config.OnFailureHooks,
+	} {
+		if err := validateHooks(hooks, setting); err != nil {
+			return err
+		}
+	}
+	if len(t.DestinationConfig) == 0 {
+		return fmt.Errorf("no valid destination configured")
+	}
+	return nil
 }
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// forcedShutdownGrace is how long the daemon waits for cancelled runs to return
+// once the shutdown timeout is exceeded, before exiting anyway
+const forcedShutdownGrace = 10 * time.Second
+
+type DaemonOptions struct {
+	ShutdownTimeout time.Duration
+	WatchConfig     bool
+}
+
+type scheduledBackupTarget struct {
+	target      *BackupTarget
+	entryId     cron.EntryID
+	fingerprint string
+}
+
+type BackupDaemon struct {
+	options     DaemonOptions
+	cron        *cron.Cron
+	ctx         context.Context
+	cancel      context.CancelFunc
+	reloadMutex sync.Mutex
+	scheduled   map[string]*scheduledBackupTarget
+	mutex       sync.Mutex
+	// running holds the target of the run in progress of each name, and retired
+	// the replaced targets whose destinations are closed once their run is done
+	running map[string]*BackupTarget
+	retired map[*BackupTarget]bool
+	jobs    sync.WaitGroup
+	state   *StateStore
+}
+
+func NewBackupDaemon(options DaemonOptions, state *StateStore) *BackupDaemon {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &BackupDaemon{
+		options:   options,
+		cron:      cron.New(cron.WithChain(cron.Recover(cron.PrintfLogger(log.StandardLogger())))),
+		ctx:       ctx,
+		cancel:    cancel,
+		scheduled: map[string]*scheduledBackupTarget{},
+		running:   map[string]*BackupTarget{},
+		retired:   map[*BackupTarget]bool{},
+		state:     state,
+	}
+}
+
+// getConfigFingerprint returns a representation of the raw settings of a target,
+// destinations included, used to detect the targets changed by a reload
+func getConfigFingerprint(name string) string {
+	return fmt.Sprintf("%v", viper.Get(name))
+}
+
+func (bd *BackupDaemon) scheduleBackupTarget(backupTarget *BackupTarget) error {
+	log.Infof("Processing backup target '%s'\n", backupTarget.Name)
+
+	prepareBackupTarget(backupTarget)
+	initBackupTargetDestinations(backupTarget, true)
+	entryId, err := launchBackupTargetCron(bd.cron, backupTarget, bd.runBackupTarget)
+	if err != nil {
+		closeBackupTargetDestinations(backupTarget)
+		return err
+	}
+	bd.scheduled[backupTarget.Name] = &scheduledBackupTarget{
+		target:      backupTarget,
+		entryId:     entryId,
+		fingerprint: getConfigFingerprint(backupTarget.Name),
+	}
+	return nil
+}
+
+func (bd *BackupDaemon) schedule(backupTargets []*BackupTarget) error {
+	bd.reloadMutex.Lock()
+	defer bd.reloadMutex.Unlock()
+	for _, backupTarget := range backupTargets {
+		if err := bd.scheduleBackupTarget(backupTarget); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reload applies the current configuration file to the scheduler: new targets
+// are added, removed ones unscheduled and changed ones replaced. Runs in progress
+// keep their previous target until they are done. An invalid configuration is
+// rejected as a whole and the previous one stays live.
+func (bd *BackupDaemon) reload() {
+	bd.reloadMutex.Lock()
+	defer bd.reloadMutex.Unlock()
+
+	backupTargets, err := loadValidBackupTargets()
+	if err != nil {
+		log.Errorf("Configuration rejected, keeping the previous one: %s\n", err.Error())
+		return
+	}
+
+	configured := make(map[string]bool)
+	for _, backupTarget := range backupTargets {
+		configured[backupTarget.Name] = true
+		previous, ok := bd.scheduled[backupTarget.Name]
+		if ok && previous.fingerprint == getConfigFingerprint(backupTarget.Name) {
+			continue
+		}
+		if ok {
+			bd.cron.Remove(previous.entryId)
+			bd.retireBackupTarget(previous.target)
+			log.Infof("[%s] Backup target changed, replacing it\n", backupTarget.Name)
+		}
+		if handleErr(bd.scheduleBackupTarget(backupTarget), "[%s] Cannot schedule backup target", backupTarget.Name) {
+			delete(bd.scheduled, backupTarget.Name)
+		}
+	}
+	for name, previous := range bd.scheduled {
+		if !configured[name] {
+			bd.cron.Remove(previous.entryId)
+			bd.retireBackupTarget(previous.target)
+			delete(bd.scheduled, name)
+			log.Infof("[%s] Backup target removed from the configuration\n", name)
+		}
+	}
+	log.Infoln("Configuration reloaded")
+}
+
+// runBackupTarget is the cron job of every target. Failures are only recorded,
+// so that the daemon keeps serving the other targets.
+func (bd *BackupDaemon) runBackupTarget(t *BackupTarget) {
+	bd.mutex.Lock()
+	if bd.running[t.Name] != nil {
+		bd.mutex.Unlock()
+		log.Warnf("[%s] Previous backup still in progress, skipping this run\n", t.Name)
+		return
+	}
+	bd.running[t.Name] = t
+	bd.mutex.Unlock()
+
+	result := processBackupTarget(bd.ctx, t)
+	result.log()
+	handleErr(bd.state.record(result), "[%s] Cannot record run in state file", t.Name)
+
+	bd.mutex.Lock()
+	delete(bd.running, t.Name)
+	retired := bd.retired[t]
+	delete(bd.retired, t)
+	bd.mutex.Unlock()
+	if retired {
+		closeBackupTargetDestinations(t)
+	}
+}
+
+// retireBackupTarget closes the destinations of a target removed from the
+// scheduler, or defers it to the end of its run in progress
+func (bd *BackupDaemon) retireBackupTarget(t *BackupTarget) {
+	bd.mutex.Lock()
+	defer bd.mutex.Unlock()
+	if bd.running[t.Name] == t {
+		bd.retired[t] = true
+		return
+	}
+	closeBackupTargetDestinations(t)
+}
+
+// closeAllDestinations closes the destinations of every known target, once no
+// run uses them anymore
+func (bd *BackupDaemon) closeAllDestinations() {
+	bd.reloadMutex.Lock()
+	defer bd.reloadMutex.Unlock()
+	bd.mutex.Lock()
+	defer bd.mutex.Unlock()
+	for _, scheduled := range bd.scheduled {
+		closeBackupTargetDestinations(scheduled.target)
+	}
+	for t := range bd.retired {
+		closeBackupTargetDestinations(t)
+	}
+	bd.retired = map[*BackupTarget]bool{}
+}
+
+// catchUp immediately runs the targets with 'catch_up' enabled whose last
+// successful run is older than their previous scheduled tick
+func (bd *BackupDaemon) catchUp() {
+	bd.reloadMutex.Lock()
+	defer bd.reloadMutex.Unlock()
+	now := time.Now()
+	for _, scheduled := range bd.scheduled {
+		t := scheduled.target
+		if !t.Config.CatchUp {
+			continue
+		}
+		lastSuccess := bd.state.getLastSuccess(t.Name)
+		missed, err := isScheduledRunMissed(t, lastSuccess, now)
+		if handleErr(err, "[%s] Cannot check for missed backups", t.Name) || !missed {
+			continue
+		}
+		if lastSuccess.IsZero() {
+			log.Infof("[%s] No successful backup recorded, catching up now\n", t.Name)
+		} else {
+			log.Infof("[%s] Scheduled backup missed since %s, catching up now\n", t.Name, lastSuccess.Format(time.RFC3339))
+		}
+		bd.jobs.Add(1)
+		go func() {
+			defer bd.jobs.Done()
+			bd.runBackupTarget(t)
+		}()
+	}
+}
+
+// run starts the scheduler and blocks until SIGINT or SIGTERM is received and
+// the daemon has shut down. The configuration is reloaded on SIGHUP and, if
+// enabled, whenever the configuration file changes.
+func (bd *BackupDaemon) run() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+	defer signal.Stop(reloadSignals)
+
+	if bd.options.WatchConfig {
+		viper.OnConfigChange(func(e fsnotify.Event) {
+			log.Infof("Configuration file changed (%s)\n", e.Op)
+			bd.reload()
+		})
+		viper.WatchConfig()
+	}
+
+	bd.cron.Start()
+	bd.catchUp()
+	log.Infoln("Ready")
+
+	for {
+		select {
+		case <-reloadSignals:
+			log.Infoln("Received SIGHUP, reloading configuration")
+			bd.reload()
+		case sig := <-signals:
+			log.Infof("Received %s, shutting down\n", sig)
+			bd.shutdown(signals)
+			return
+		}
+	}
+}
+
+// shutdown stops scheduling new runs and waits for the runs in progress to
+// finish. Runs still going after the shutdown timeout, or after a second
+// signal, get their context cancelled.
+func (bd *BackupDaemon) shutdown(signals <-chan os.Signal) {
+	cronStopped := bd.cron.Stop()
+	defer deleteAllTempWorkdirs()
+	defer bd.closeAllDestinations()
+	defer bd.cancel()
+
+	// Catch-up runs are started outside of cron, so they are awaited separately
+	stopped := make(chan struct{})
+	go func() {
+		<-cronStopped.Done()
+		bd.jobs.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		log.Infoln("Every backup in progress is done")
+		return
+	case <-time.After(bd.options.ShutdownTimeout):
+		log.Warnf("Backups still in progress after %s, cancelling them\n", bd.options.ShutdownTimeout)
+	case sig := <-signals:
+		log.Warnf("Received %s again, cancelling backups in progress\n", sig)
+	}
+
+	bd.cancel()
+	select {
+	case <-stopped:
+		log.Infoln("Every backup in progress is cancelled")
+	case <-time.After(forcedShutdownGrace):
+		log.Errorln("Backups in progress did not return after cancellation, exiting anyway")
+	}
+}
+
+// newSignalContext returns a context cancelled on SIGINT or SIGTERM, for one-shot commands
+func newSignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Warnf("Received %s, cancelling\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
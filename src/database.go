@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DatabaseConfig tells how to dump the database of a postgres or mysql target.
+// A sqlite target reads its database file from 'path' instead.
+type DatabaseConfig struct {
+	// Binary is the dump program, pg_dump or mysqldump from the PATH by default
+	Binary   string `mapstructure:"binary"`
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+	Name     string `mapstructure:"name"`
+	// Options are extra arguments passed to the dump program
+	Options []string `mapstructure:"options"`
+}
+
+func isDatabaseTargetType(targetType string) bool {
+	switch targetType {
+	case postgresTargetType, mysqlTargetType, sqliteTargetType:
+		return true
+	}
+	return false
+}
+
+// getDatabaseDumpName returns the name of the dump in archives
+func getDatabaseDumpName(t *BackupTarget) string {
+	if t.Config.Type == sqliteTargetType {
+		return filepath.Base(t.Config.Path)
+	}
+	return t.Config.Database.Name + ".sql"
+}
+
+func getDatabaseDumpBinary(t *BackupTarget) string {
+	if len(t.Config.Database.Binary) > 0 {
+		return parseTilde(t.Config.Database.Binary)
+	}
+	if t.Config.Type == mysqlTargetType {
+		return "mysqldump"
+	}
+	return "pg_dump"
+}
+
+func validateDatabaseTarget(t *BackupTarget) error {
+	if len(t.Config.Paths) > 0 {
+		return fmt.Errorf("%s targets do not support 'paths'", t.Config.Type)
+	}
+	if t.Config.GitBundle || t.Config.PreserveAbsoluteHierarchy {
+		return fmt.Errorf("%s targets do not support 'git_bundle' or 'preserve_absolute_hierarchy'", t.Config.Type)
+	}
+	if t.Config.Streaming {
+		return fmt.Errorf("%s targets do not support 'streaming', the dump being written to a temporary file first", t.Config.Type)
+	}
+	if t.Config.Type == sqliteTargetType {
+		if len(t.Config.Path) == 0 {
+			return fmt.Errorf("missing 'path'")
+		}
+		info, err := os.Stat(t.Config.Path)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("'%s' is not a database file", t.Config.Path)
+		}
+		return validateSqliteBackup()
+	}
+	if len(t.Config.Path) > 0 {
+		return fmt.Errorf("%s targets do not support 'path'", t.Config.Type)
+	}
+	if len(t.Config.Database.Name) == 0 {
+		return fmt.Errorf("missing 'database.name'")
+	}
+	if _, err := exec.LookPath(getDatabaseDumpBinary(t)); err != nil {
+		return fmt.Errorf("cannot find the dump program: %w", err)
+	}
+	return nil
+}
+
+func getPostgresDumpArgs(c DatabaseConfig, dumpPath string) []string {
+	args := []string{"--file=" + dumpPath, "--no-password"}
+	if len(c.Host) > 0 {
+		args = append(args, "--host="+c.Host)
+	}
+	if c.Port > 0 {
+		args = append(args, "--port="+strconv.Itoa(c.Port))
+	}
+	if len(c.User) > 0 {
+		args = append(args, "--username="+c.User)
+	}
+	args = append(args, c.Options...)
+	return append(args, "--dbname="+c.Name)
+}
+
+func getMysqlDumpArgs(c DatabaseConfig, dumpPath string) []string {
+	// A single transaction gives a consistent dump of InnoDB tables without locking them
+	args := []string{"--result-file=" + dumpPath, "--single-transaction", "--routines", "--triggers"}
+	if len(c.Host) > 0 {
+		args = append(args, "--host="+c.Host)
+	}
+	if c.Port > 0 {
+		args = append(args, "--port="+strconv.Itoa(c.Port))
+	}
+	if len(c.User) > 0 {
+		args = append(args, "--user="+c.User)
+	}
+	args = append(args, c.Options...)
+	return append(args, "--databases", c.Name)
+}
+
+// runSourceCommand runs a command producing the source of a target. Its error
+// output is reported with the exit status, or logged as a warning if it succeeds.
+func runSourceCommand(ctx context.Context, t *BackupTarget, cmd *exec.Cmd, name string) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := runCommand(ctx, cmd); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	if stderr.Len() > 0 {
+		log.Warnf("[%s] %s: %s\n", t.Name, name, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// runDumpCommand runs a dump program, the password being passed through the
+// environment so it does not show in the process list
+func runDumpCommand(ctx context.Context, t *BackupTarget, args []string, passwordEnv string) error {
+	binary := getDatabaseDumpBinary(t)
+	cmd := newCommand(binary, args...)
+	cmd.Env = os.Environ()
+	if len(t.Config.Database.Password) > 0 {
+		cmd.Env = append(cmd.Env, passwordEnv+"="+t.Config.Database.Password)
+	}
+	return runSourceCommand(ctx, t, cmd, filepath.Base(binary))
+}
+
+// getSqliteURI returns the URI opening a database file with the given mode (ro
+// or rwc), its path escaped so that characters such as '?' or '#' are not taken
+// as URI syntax
+func getSqliteURI(dbPath string, mode string) string {
+	// A relative path would be read as the authority of the URI
+	if absPath, err := filepath.Abs(dbPath); err == nil {
+		dbPath = absPath
+	}
+	uriPath := filepath.ToSlash(dbPath)
+	if len(filepath.VolumeName(dbPath)) > 0 {
+		uriPath = "/" + uriPath
+	}
+	uri := url.URL{Scheme: "file", Path: uriPath, RawQuery: "mode=" + mode}
+	return uri.String()
+}
+
+// checkSqliteRestoreDir refuses to restore a database next to a write-ahead
+// log, which SQLite would replay into the restored copy
+func checkSqliteRestoreDir(dir string, name string) error {
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if _, err := os.Lstat(filepath.Join(dir, name+suffix)); err == nil {
+			return fmt.Errorf("'%s' exists in '%s', stop the programs using the database and remove it, or restore elsewhere", name+suffix, dir)
+		}
+	}
+	return nil
+}
+
+// getDumpPath returns where the dump of a run is written, in the temporary
+// working directory of the target
+func getDumpPath(t *BackupTarget, name string) (string, error) {
+	if err := createBackupTargetTempWorkdir(t); err != nil {
+		return "", err
+	}
+	dumpDir := filepath.Join(t.TmpWorkdir, "dump")
+	if err := os.Mkdir(dumpDir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dumpDir, name), nil
+}
+
+// dumpDatabaseTarget dumps the database of a target into its temporary working
+// directory, and makes the dump the only source of the run so that it is
+// archived and stored like the files of other targets
+func dumpDatabaseTarget(ctx context.Context, t *BackupTarget) error {
+	name := getDatabaseDumpName(t)
+	dumpPath, err := getDumpPath(t, name)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("[%s] Dumping %s database\n", t.Name, t.Config.Type)
+	switch t.Config.Type {
+	case postgresTargetType:
+		err = runDumpCommand(ctx, t, getPostgresDumpArgs(t.Config.Database, dumpPath), "PGPASSWORD")
+	case mysqlTargetType:
+		err = runDumpCommand(ctx, t, getMysqlDumpArgs(t.Config.Database, dumpPath), "MYSQL_PWD")
+	case sqliteTargetType:
+		err = backupSqliteDatabase(ctx, t, t.Config.Path, dumpPath)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot dump database: %w", err)
+	}
+	info, err := os.Stat(dumpPath)
+	if err != nil {
+		return fmt.Errorf("no database dump was written: %w", err)
+	}
+	log.Infof("[%s] Dumped database (%d bytes)\n", t.Name, info.Size())
+	t.Sources = []*BackupSource{{Path: dumpPath, Prefix: name}}
+	return nil
+}
@@ -0,0 +1,64 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteBackupStep is the number of pages copied at once by the SQLite online
+// backup, between which the run can be cancelled
+const sqliteBackupStep = 1024
+
+func validateSqliteBackup() error {
+	return nil
+}
+
+// backupSqliteDatabase copies a database with the SQLite online backup API,
+// which gives a consistent copy even while other processes write to it
+func backupSqliteDatabase(ctx context.Context, _ *BackupTarget, srcPath string, dumpPath string) error {
+	src, err := sql.Open("sqlite3", getSqliteURI(srcPath, "ro"))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := sql.Open("sqlite3", getSqliteURI(dumpPath, "rwc"))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(dstDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			backup, err := dstDriverConn.(*sqlite3.SQLiteConn).Backup("main", srcDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			for done := false; !done; {
+				if err := ctx.Err(); err != nil {
+					backup.Finish()
+					return err
+				}
+				if done, err = backup.Step(sqliteBackupStep); err != nil {
+					backup.Finish()
+					return err
+				}
+			}
+			return backup.Finish()
+		})
+	})
+}
@@ -0,0 +1,95 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDatabase(t *testing.T, dbPath string) *sql.DB {
+	db, err := sql.Open("sqlite3", getSqliteURI(dbPath, "rwc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestBackupSqliteDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobackup_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// URI syntax characters in the name must not change the file opened
+	srcPath := filepath.Join(dir, "app?mode=memory#50%.db")
+	dumpPath := filepath.Join(dir, "dump?.db")
+
+	src := openTestDatabase(t, srcPath)
+	defer src.Close()
+	// The database is kept open in WAL mode, the rows being only in the log
+	for _, query := range []string{
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA wal_autocheckpoint=0",
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)",
+	} {
+		if _, err := src.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := src.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		if _, err := tx.Exec("INSERT INTO items (name) VALUES (?)", "item"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	target := &BackupTarget{Name: "test"}
+	if err := backupSqliteDatabase(context.Background(), target, srcPath, dumpPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app")); err == nil {
+		t.Error("the database path was cut at the '?' of its name")
+	}
+
+	dump := openTestDatabase(t, dumpPath)
+	defer dump.Close()
+	var count int
+	if err := dump.QueryRow("SELECT COUNT(*) FROM items").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 5000 {
+		t.Errorf("the copy has %d rows, want 5000", count)
+	}
+}
+
+func TestBackupSqliteDatabaseCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobackup_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srcPath := filepath.Join(dir, "app.db")
+	src := openTestDatabase(t, srcPath)
+	defer src.Close()
+	if _, err := src.Exec("CREATE TABLE items (id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := backupSqliteDatabase(ctx, &BackupTarget{Name: "test"}, srcPath, filepath.Join(dir, "dump.db")); err == nil {
+		t.Error("a cancelled backup succeeded")
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// sqliteBackupFile is the name the sqlite3 shell writes the copy to, so that the
+// path given to the '.backup' command never needs quoting
+const sqliteBackupFile = "sqlite_backup.db"
+
+// validateSqliteBackup checks for the sqlite3 shell, which copies databases
+// when the SQLite driver is not built in
+func validateSqliteBackup() error {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return fmt.Errorf("cannot find the sqlite3 program, required by builds without cgo: %w", err)
+	}
+	return nil
+}
+
+// backupSqliteDatabase copies a database with the '.backup' command of the
+// sqlite3 shell, which uses the SQLite online backup API
+func backupSqliteDatabase(ctx context.Context, t *BackupTarget, srcPath string, dumpPath string) error {
+	cmd := newCommand("sqlite3", "-readonly", getSqliteURI(srcPath, "ro"), ".backup "+sqliteBackupFile)
+	cmd.Dir = filepath.Dir(dumpPath)
+	if err := runSourceCommand(ctx, t, cmd, "sqlite3"); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(cmd.Dir, sqliteBackupFile), dumpPath)
+}
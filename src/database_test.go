@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetSqliteURI(t *testing.T) {
+	tests := []struct {
+		path string
+		mode string
+		uri  string
+	}{
+		{"/var/lib/app.db", "ro", "file:///var/lib/app.db?mode=ro"},
+		{"/var/lib/my app.db", "rwc", "file:///var/lib/my%20app.db?mode=rwc"},
+		{"/data/a?b#c%d.db", "ro", "file:///data/a%3Fb%23c%25d.db?mode=ro"},
+	}
+	for _, test := range tests {
+		if uri := getSqliteURI(filepath.FromSlash(test.path), test.mode); uri != test.uri {
+			t.Errorf("getSqliteURI(%q, %q) = %q, want %q", test.path, test.mode, uri, test.uri)
+		}
+	}
+	// A relative path must not become the host of the URI
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := getSqliteURI(filepath.Join(cwd, "relative", "app.db"), "ro")
+	if uri := getSqliteURI(filepath.Join("relative", "app.db"), "ro"); uri != want {
+		t.Errorf("getSqliteURI(\"relative/app.db\") = %q, want %q", uri, want)
+	}
+}
+
+func TestCheckSqliteRestoreDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobackup_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.db"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSqliteRestoreDir(dir, "app.db"); err != nil {
+		t.Errorf("restoring next to a database without WAL failed: %s", err)
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "app.db"+suffix), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkSqliteRestoreDir(dir, "app.db"); err == nil {
+			t.Errorf("restoring next to an app.db%s file succeeded", suffix)
+		}
+		os.Remove(filepath.Join(dir, "app.db"+suffix))
+	}
+}
@@ -2,22 +2,53 @@ package main
 
 import (
 	"context"
+	"io"
 	"time"
 )
 
+const (
+	filesTargetType      = "files"
+	repositoryTargetType = "repository"
+	postgresTargetType   = "postgres"
+	mysqlTargetType      = "mysql"
+	sqliteTargetType     = "sqlite"
+	commandTargetType    = "command"
+)
+
 type BackupTargetConfig struct {
-	Type                      string   `mapstructure:"type"`
-	Path                      string   `mapstructure:"path"`
-	Format                    string   `mapstructure:"format"`
-	Frequency                 string   `mapstructure:"frequency"`
-	Cron                      string   `mapstructure:"cron"`
-	KeepOnly                  int      `mapstructure:"keep_only"`
-	Replace                   bool     `mapstructure:"replace"`
-	DateSuffix                bool     `mapstructure:"date_suffix"`
-	ExcludeVcs                bool     `mapstructure:"exclude_vcs"`
-	PreserveAbsoluteHierarchy bool     `mapstructure:"preserve_absolute_hierarchy"`
-	Destinations              []string `mapstructure:"destinations"`
-	ExcludeDirs               []string `mapstructure:"exclude_dirs"`
+	Type                      string               `mapstructure:"type"`
+	Path                      string               `mapstructure:"path"`
+	Paths                     []BackupSource       `mapstructure:"paths"`
+	Format                    string               `mapstructure:"format"`
+	CompressionLevel          int                  `mapstructure:"compression_level"`
+	Frequency                 string               `mapstructure:"frequency"`
+	Cron                      string               `mapstructure:"cron"`
+	CatchUp                   bool                 `mapstructure:"catch_up"`
+	KeepOnly                  int                  `mapstructure:"keep_only"`
+	Replace                   bool                 `mapstructure:"replace"`
+	Streaming                 bool                 `mapstructure:"streaming"`
+	Incremental               bool                 `mapstructure:"incremental"`
+	FullEvery                 int                  `mapstructure:"full_every"`
+	DateSuffix                bool                 `mapstructure:"date_suffix"`
+	ExcludeVcs                bool                 `mapstructure:"exclude_vcs"`
+	GitBundle                 bool                 `mapstructure:"git_bundle"`
+	PreserveAbsoluteHierarchy bool                 `mapstructure:"preserve_absolute_hierarchy"`
+	PreserveXattrs            bool                 `mapstructure:"preserve_xattrs"`
+	Destinations              []string             `mapstructure:"destinations"`
+	ExcludeDirs               []string             `mapstructure:"exclude_dirs"`
+	Include                   []string             `mapstructure:"include"`
+	Exclude                   []string             `mapstructure:"exclude"`
+	UseGitignore              bool                 `mapstructure:"use_gitignore"`
+	Encryption                EncryptionConfig     `mapstructure:"encryption"`
+	Repository                RepositoryConfig     `mapstructure:"repository"`
+	Database                  DatabaseConfig       `mapstructure:"database"`
+	Command                   CommandTargetConfig  `mapstructure:"command"`
+	Snapshot                  VolumeSnapshotConfig `mapstructure:"snapshot"`
+	// FailOnChange fails the run when files change while being backed up
+	FailOnChange   bool         `mapstructure:"fail_on_change"`
+	PreHooks       []HookConfig `mapstructure:"pre_hooks"`
+	PostHooks      []HookConfig `mapstructure:"post_hooks"`
+	OnFailureHooks []HookConfig `mapstructure:"on_failure_hooks"`
 }
 
 type BackupItem struct {
@@ -26,28 +57,66 @@ type BackupItem struct {
 }
 
 type BackupDestination interface {
-	init() bool
+	// init prepares the destination, checking that it can be reached and, if
+	// checkWrite is set, written to. It is called again before the next run of
+	// destinations failing it.
+	init(checkWrite bool) bool
 	isReady() bool
-	runBackup()
+	// close releases the clients and connections opened by the destination
+	close() error
+	// runBackup stores the archive read from r under the given name. size is -1
+	// when the archive is streamed while being built.
+	runBackup(ctx context.Context, name string, r io.Reader, size int64) error
 	buildBackupsList(context.Context) ([]BackupItem, error)
-	cleanOldBackups()
+	fetchBackup(context.Context, BackupItem, io.Writer) error
+	cleanOldBackups(context.Context) error
+	// Object methods store the chunks and snapshots of repository targets, keys
+	// being slash separated and relative to the destination folder
+	putObject(ctx context.Context, key string, r io.Reader, size int64) error
+	getObject(ctx context.Context, key string, w io.Writer) error
+	listObjects(ctx context.Context, prefix string) ([]string, error)
+	deleteObject(ctx context.Context, key string) error
 	setTarget(*BackupTarget)
 	getName() string
 	getTarget() *BackupTarget
 }
 
+type DestinationRunResult struct {
+	Destination string
+	Duration    time.Duration
+	Err         error
+	CleanErr    error
+}
+
+type BackupRunResult struct {
+	Target       string
+	Archive      string
+	Started      time.Time
+	Duration     time.Duration
+	Files        int
+	SkippedFiles int
+	ChangedFiles int
+	Bytes        int64
+	Err          error
+	Destinations []DestinationRunResult
+}
+
 type BackupTarget struct {
 	Name              string
 	TmpWorkdir        string
 	Archive           string
 	Ext               string
+	Sources           []*BackupSource
 	Files             []string
+	GitRepositories   []string
+	Manifest          *BackupManifest
 	Config            BackupTargetConfig
 	DestinationConfig []BackupDestination
 }
 
-var parseConfigFnMap = map[string]func(string, *BackupTarget){
+var parseConfigFnMap = map[string]func(string, *BackupTarget) error{
 	"local": parseConfigLocalDestination,
 	"aws":   parseConfigAwsDestination,
 	"gcp":   parseConfigGcpDestination,
+	"sftp":  parseConfigSftpDestination,
 }
@@ -2,46 +2,96 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	"os"
-	"path/filepath"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
 )
 
+// defaultS3CompatibleRegion is the region used with a custom endpoint when none
+// is set, most S3-compatible servers ignoring it but requests being signed with it
+const defaultS3CompatibleRegion = "us-east-1"
+
 type BackupDestinationAws struct {
 	ready       bool
 	target      *BackupTarget
 	client      *s3.Client
 	Credentials string `mapstructure:"credentials"`
 	Config      string `mapstructure:"config"`
-	Folder      string `mapstructure:"folder"`
-	Bucket      string `mapstructure:"bucket"`
+	Profile     string `mapstructure:"profile"`
+	Region      string `mapstructure:"region"`
+	// Endpoint is the URL of an S3-compatible server such as MinIO, AWS by default
+	Endpoint string `mapstructure:"endpoint"`
+	// PathStyle addresses buckets as 'endpoint/bucket' instead of 'bucket.endpoint',
+	// which most S3-compatible servers require
+	PathStyle bool `mapstructure:"path_style"`
+	// Static keys take precedence over the credentials of the shared files
+	AccessKeyId     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+	Folder          string `mapstructure:"folder"`
+	Bucket          string `mapstructure:"bucket"`
+	// PartSize is the size in MiB of the parts of multipart uploads, 5 by default.
+	// Uploads have at most 10000 parts, which bounds the size of streamed archives.
+	PartSize    int64 `mapstructure:"part_size"`
+	Concurrency int   `mapstructure:"concurrency"`
+	// StorageClass is the class of the stored objects, such as STANDARD_IA or GLACIER_IR
+	StorageClass string `mapstructure:"storage_class"`
+	// ServerSideEncryption is AES256 for SSE-S3 or aws:kms for SSE-KMS, with the
+	// key KmsKeyId or the AWS managed key when it is empty
+	ServerSideEncryption string `mapstructure:"server_side_encryption"`
+	KmsKeyId             string `mapstructure:"kms_key_id"`
+	// Tags are 'key=value' pairs set on the stored objects
+	Tags []string `mapstructure:"tags"`
+	// ObjectLockMode (GOVERNANCE or COMPLIANCE) and ObjectLockRetention protect the
+	// backup archives from deletion, in a bucket with object lock enabled
+	ObjectLockMode      string        `mapstructure:"object_lock_mode"`
+	ObjectLockRetention time.Duration `mapstructure:"object_lock_retention"`
+
+	uploader *manager.Uploader
+	tagging  string
 }
 
 func NewBackupDestinationAws() *BackupDestinationAws {
 	return &BackupDestinationAws{}
 }
 
-func parseConfigAwsDestination(unmarshalKey string, t *BackupTarget) {
+func parseConfigAwsDestination(unmarshalKey string, t *BackupTarget) error {
 	awsDest := NewBackupDestinationAws()
-	handleFatalErr(
-		viper.UnmarshalKey(unmarshalKey, &awsDest),
-		"Cannot parse aws backup destination %s\n",
-		unmarshalKey)
+	if err := viper.UnmarshalKey(unmarshalKey, &awsDest); err != nil {
+		return fmt.Errorf("cannot parse aws backup destination %s: %w", unmarshalKey, err)
+	}
 	if len(awsDest.Credentials) > 0 {
 		awsDest.Credentials = parseTilde(awsDest.Credentials)
 	}
 	if len(awsDest.Config) > 0 {
 		awsDest.Config = parseTilde(awsDest.Config)
 	}
+	awsDest.StorageClass = strings.ToUpper(awsDest.StorageClass)
+	awsDest.ObjectLockMode = strings.ToUpper(awsDest.ObjectLockMode)
 	t.DestinationConfig = append(t.DestinationConfig, awsDest)
+	return nil
 }
 
-func (d *BackupDestinationAws) init() bool {
-	return false
+// newClient builds the S3 client from the shared configuration files, then
+// the options of the destination
+func (d *BackupDestinationAws) newClient(ctx context.Context) (*s3.Client, error) {
+	if len(d.Bucket) == 0 {
+		return nil, fmt.Errorf("'bucket' is required")
+	}
+	if (len(d.AccessKeyId) > 0) != (len(d.SecretAccessKey) > 0) {
+		return nil, fmt.Errorf("'access_key_id' and 'secret_access_key' must be set together")
+	}
 	var sharedCredentialsFiles []string
 	var sharedConfigFiles []string
 
@@ -51,108 +101,269 @@ func (d *BackupDestinationAws) init() bool {
 	if len(d.Config) > 0 {
 		sharedConfigFiles = []string{d.Config}
 	}
-
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
+	options := []func(*config.LoadOptions) error{
 		config.WithSharedCredentialsFiles(sharedCredentialsFiles),
 		config.WithSharedConfigFiles(sharedConfigFiles),
-	)
-	if handleErr(err) {
-		d.ready = false
-		return false
+	}
+	if len(d.Profile) > 0 {
+		options = append(options, config.WithSharedConfigProfile(d.Profile))
+	}
+	region := d.Region
+	if len(region) == 0 && len(d.Endpoint) > 0 {
+		region = defaultS3CompatibleRegion
+	}
+	if len(region) > 0 {
+		options = append(options, config.WithRegion(region))
+	}
+	if len(d.AccessKeyId) > 0 {
+		options = append(options, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(d.AccessKeyId, d.SecretAccessKey, d.SessionToken),
+		))
 	}
 
-	d.client = s3.NewFromConfig(cfg)
-	d.ready = true
-	return d.ready
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if len(d.Endpoint) > 0 {
+			o.EndpointResolver = s3.EndpointResolverFromURL(d.Endpoint)
+		}
+		o.UsePathStyle = d.PathStyle
+	}), nil
 }
 
-func (d *BackupDestinationAws) runBackup() {
-	var sharedCredentialsFiles []string
-	var sharedConfigFiles []string
+// init builds the client shared by every operation of the destination, then
+// checks that the bucket exists and, if checkWrite is set, accepts writes
+func (d *BackupDestinationAws) init(checkWrite bool) bool {
+	var err error
+	d.ready = false
+	if handleErr(d.parseObjectOptions(), "%s Invalid configuration", getDestLogPrefix(d)) {
+		return false
+	}
+	d.client, err = d.newClient(context.Background())
+	if handleErr(err, "%s Cannot create S3 client", getDestLogPrefix(d)) {
+		return false
+	}
+	d.uploader = manager.NewUploader(d.client, func(u *manager.Uploader) {
+		if d.PartSize > 0 {
+			u.PartSize = d.PartSize << 20
+		}
+		if d.Concurrency > 0 {
+			u.Concurrency = d.Concurrency
+		}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), destinationProbeTimeout)
+	defer cancel()
+	d.ready = !handleErr(d.probe(ctx, checkWrite), "%s Destination check failed", getDestLogPrefix(d))
+	return d.ready
+}
 
-	if len(d.Credentials) > 0 {
-		sharedCredentialsFiles = []string{d.Credentials}
+func (d *BackupDestinationAws) probe(ctx context.Context, checkWrite bool) error {
+	if _, err := d.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(d.Bucket)}); err != nil {
+		return fmt.Errorf("cannot access bucket '%s': %w", d.Bucket, err)
 	}
-	if len(d.Config) > 0 {
-		sharedConfigFiles = []string{d.Config}
+	if !checkWrite {
+		return nil
 	}
+	return probeDestinationWrite(ctx, d)
+}
 
-	cfg, err := config.LoadDefaultConfig(
-		context.TODO(),
-		config.WithSharedCredentialsFiles(sharedCredentialsFiles),
-		config.WithSharedConfigFiles(sharedConfigFiles),
-	)
-	if handleErr(err) {
-		return
+// parseObjectOptions checks the options applied to uploaded objects
+func (d *BackupDestinationAws) parseObjectOptions() error {
+	if d.PartSize != 0 && d.PartSize<<20 < manager.MinUploadPartSize {
+		return fmt.Errorf("'part_size' must be at least %d MiB", manager.MinUploadPartSize>>20)
+	}
+	if d.Concurrency < 0 {
+		return fmt.Errorf("'concurrency' cannot be negative")
+	}
+	var storageClasses, encryptions, lockModes []string
+	for _, v := range types.StorageClass("").Values() {
+		storageClasses = append(storageClasses, string(v))
+	}
+	for _, v := range types.ServerSideEncryption("").Values() {
+		encryptions = append(encryptions, string(v))
+	}
+	for _, v := range types.ObjectLockMode("").Values() {
+		lockModes = append(lockModes, string(v))
+	}
+	if len(d.StorageClass) > 0 && !stringInSlice(d.StorageClass, storageClasses) {
+		return fmt.Errorf("unknown storage class '%s'", d.StorageClass)
+	}
+	if len(d.ServerSideEncryption) > 0 && !stringInSlice(d.ServerSideEncryption, encryptions) {
+		return fmt.Errorf("unknown server side encryption '%s'", d.ServerSideEncryption)
+	}
+	if len(d.KmsKeyId) > 0 && types.ServerSideEncryption(d.ServerSideEncryption) != types.ServerSideEncryptionAwsKms {
+		return fmt.Errorf("'kms_key_id' requires 'server_side_encryption' to be '%s'", types.ServerSideEncryptionAwsKms)
+	}
+	if len(d.ObjectLockMode) > 0 && !stringInSlice(d.ObjectLockMode, lockModes) {
+		return fmt.Errorf("unknown object lock mode '%s'", d.ObjectLockMode)
+	}
+	if (len(d.ObjectLockMode) > 0) != (d.ObjectLockRetention > 0) {
+		return fmt.Errorf("'object_lock_mode' and 'object_lock_retention' must be set together")
+	}
+	tags := url.Values{}
+	for _, tag := range d.Tags {
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return fmt.Errorf("invalid tag '%s', expected 'key=value'", tag)
+		}
+		tags.Add(parts[0], parts[1])
 	}
+	d.tagging = tags.Encode()
+	return nil
+}
 
-	client := s3.NewFromConfig(cfg)
-	log.Infof("%s Upload an object to the bucket '%s'\n", getDestLogPrefix(d), d.Bucket)
-	stat, err := os.Stat(d.target.Archive)
-	if handleErr(err) {
-		return
+// newPutObjectInput returns the upload request of an object with the options
+// of the destination. Object lock only applies to backup archives, repository
+// chunks being shared by snapshots and removed once unused.
+func (d *BackupDestinationAws) newPutObjectInput(key string, r io.Reader, locked bool) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(d.Bucket),
+		Key:                  aws.String(key),
+		Body:                 r,
+		StorageClass:         types.StorageClass(d.StorageClass),
+		ServerSideEncryption: types.ServerSideEncryption(d.ServerSideEncryption),
 	}
-	file, err := os.Open(d.target.Archive)
-	if handleErr(err) {
-		return
+	if len(d.KmsKeyId) > 0 {
+		input.SSEKMSKeyId = aws.String(d.KmsKeyId)
 	}
-	objectKey := filepath.Base(d.target.Archive)
-	if len(d.Folder) > 0 {
-		objectKey = filepath.Join(d.Folder, objectKey)
+	if len(d.tagging) > 0 {
+		input.Tagging = aws.String(d.tagging)
 	}
-	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:        aws.String(d.Bucket),
-		Key:           aws.String(objectKey),
-		Body:          file,
-		ContentLength: stat.Size(),
-	})
-	if handleErr(file.Close()) {
-		return
+	if locked && len(d.ObjectLockMode) > 0 {
+		input.ObjectLockMode = types.ObjectLockMode(d.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = aws.Time(time.Now().Add(d.ObjectLockRetention))
+		// S3 requires a checksum of the content of objects uploaded with a retention
+		input.ChecksumAlgorithm = types.ChecksumAlgorithmCrc32
+	}
+	return input
+}
+
+// close has nothing to release, the S3 client holding no connection of its own
+func (d *BackupDestinationAws) close() error {
+	return nil
+}
+
+// runBackup uploads the archive with the upload manager, in parts if it is larger
+// than the part size, since the length of streamed archives is unknown and a
+// single request is limited to 5GB
+func (d *BackupDestinationAws) runBackup(ctx context.Context, name string, r io.Reader, _ int64) error {
+	log.Infof("%s Upload an object to the bucket '%s'\n", getDestLogPrefix(d), d.Bucket)
+	if _, err := d.uploader.Upload(ctx, d.newPutObjectInput(d.getObjectKey(name), r, true)); err != nil {
+		return err
 	}
-	handleErr(err)
 	log.Infof("%s Backup uploaded to bucket %s\n", getDestLogPrefix(d), d.Bucket)
+	return nil
 }
 
+// buildBackupsList lists the objects below the folder of the destination, page
+// by page
 func (d *BackupDestinationAws) buildBackupsList(ctx context.Context) ([]BackupItem, error) {
 	var backupItems []BackupItem
 
-	objectsList, err := d.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+	paginator := s3.NewListObjectsV2Paginator(d.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(d.Bucket),
+		Prefix: aws.String(d.getFolderPrefix()),
 	})
-	if err != nil {
-		return nil, err
-	}
-	for _, object := range objectsList.Contents {
-		if doesBackupNameMatch(d.target, *object.Key) {
-			backupItems = append(backupItems, BackupItem{
-				Name: *object.Key,
-				Date: *object.LastModified,
-			})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			if doesBackupNameMatch(d.target, *object.Key) {
+				backupItems = append(backupItems, BackupItem{
+					Name: *object.Key,
+					Date: *object.LastModified,
+				})
+			}
 		}
 	}
 	return backupItems, nil
 }
 
-func (d *BackupDestinationAws) cleanOldBackups() {
-	backupItems, err := d.buildBackupsList(context.TODO())
-
-	if handleErr(err) {
-		return
+func (d *BackupDestinationAws) fetchBackup(ctx context.Context, item BackupItem, w io.Writer) error {
+	object, err := d.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(d.Bucket),
+		Key:    aws.String(item.Name),
+	})
+	if err != nil {
+		return err
 	}
-	sortBackups(d.target, backupItems)
+	defer object.Body.Close()
+	_, err = io.Copy(w, object.Body)
+	return err
+}
 
-	for i := 0; i < len(backupItems)-d.target.Config.KeepOnly; i++ {
-		_, err := d.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+func (d *BackupDestinationAws) cleanOldBackups(ctx context.Context) error {
+	backupItems, err := d.buildBackupsList(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range getBackupsToRemove(d.target, backupItems) {
+		_, err := d.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 			Bucket: aws.String(d.Bucket),
-			Key:    aws.String(backupItems[i].Name),
+			Key:    aws.String(item.Name),
 		})
-		if handleErr(err) {
-			return
+		if err != nil {
+			return err
 		}
-		log.Debugf("%s Removed old backup object '%s'\n", getDestLogPrefix(d), backupItems[i].Name)
+		log.Debugf("%s Removed old backup object '%s'\n", getDestLogPrefix(d), item.Name)
 	}
 	log.Infoln(getDestLogPrefix(d), "Cleaned old backups")
+	return nil
+}
+
+func (d *BackupDestinationAws) getObjectKey(key string) string {
+	if len(d.Folder) > 0 {
+		return path.Join(d.Folder, key)
+	}
+	return key
+}
+
+// getFolderPrefix returns the prefix of the keys of the objects in the folder
+func (d *BackupDestinationAws) getFolderPrefix() string {
+	if len(d.Folder) > 0 {
+		return strings.TrimSuffix(d.Folder, "/") + "/"
+	}
+	return ""
+}
+
+func (d *BackupDestinationAws) putObject(ctx context.Context, key string, r io.Reader, _ int64) error {
+	_, err := d.uploader.Upload(ctx, d.newPutObjectInput(d.getObjectKey(key), r, false))
+	return err
+}
+
+func (d *BackupDestinationAws) getObject(ctx context.Context, key string, w io.Writer) error {
+	return d.fetchBackup(ctx, BackupItem{Name: d.getObjectKey(key)}, w)
+}
+
+func (d *BackupDestinationAws) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	folderPrefix := d.getFolderPrefix()
+	paginator := s3.NewListObjectsV2Paginator(d.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(d.Bucket),
+		Prefix: aws.String(d.getObjectKey(prefix) + "/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(*object.Key, folderPrefix))
+		}
+	}
+	return keys, nil
+}
+
+func (d *BackupDestinationAws) deleteObject(ctx context.Context, key string) error {
+	_, err := d.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(d.Bucket),
+		Key:    aws.String(d.getObjectKey(key)),
+	})
+	return err
 }
 
 func (d *BackupDestinationAws) getName() string {
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestS3Server starts an in-memory S3 server with an empty bucket, returning
+// its clock so that objects get distinct modification dates. The clock being
+// fixed, the server does not check the date of the requests.
+func newTestS3Server(t *testing.T, bucket string) (*httptest.Server, gofakes3.TimeSourceAdvancer) {
+	clock := gofakes3.FixedTimeSource(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	backend := s3mem.New(s3mem.WithTimeSource(clock))
+	if err := backend.CreateBucket(bucket); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(gofakes3.New(backend, gofakes3.WithTimeSource(clock), gofakes3.WithTimeSkewLimit(0)).Server())
+	t.Cleanup(server.Close)
+	return server, clock
+}
+
+func newTestAwsDestination(t *testing.T, endpoint string, folder string, target *BackupTarget) *BackupDestinationAws {
+	d := NewBackupDestinationAws()
+	d.Endpoint = endpoint
+	d.PathStyle = true
+	d.AccessKeyId = "test"
+	d.SecretAccessKey = "test"
+	d.Bucket = "backups"
+	d.Folder = folder
+	d.setTarget(target)
+	if !d.init(true) {
+		t.Fatal("the destination failed to initialize")
+	}
+	return d
+}
+
+func TestAwsDestinationBackups(t *testing.T) {
+	server, clock := newTestS3Server(t, "backups")
+	target := &BackupTarget{Name: "docs", Ext: ".tar.gz", Config: BackupTargetConfig{DateSuffix: true, KeepOnly: 2}}
+	d := newTestAwsDestination(t, server.URL, "hosts/web", target)
+	// A destination of another folder of the bucket, which must not see the backups
+	other := newTestAwsDestination(t, server.URL, "hosts/db", target)
+	ctx := context.Background()
+
+	names := []string{"docs_20240101_000000.tar.gz", "docs_20240102_000000.tar.gz", "docs_20240103_000000.tar.gz"}
+	for _, name := range names {
+		if err := d.runBackup(ctx, name, strings.NewReader(name), 0); err != nil {
+			t.Fatalf("runBackup(%q): %s", name, err)
+		}
+		clock.Advance(time.Hour)
+	}
+	if err := d.putObject(ctx, "other_20240101_000000.tar.gz", strings.NewReader("other"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := d.buildBackupsList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("got %d backups, want 3: %v", len(items), items)
+	}
+	for _, item := range items {
+		if !strings.HasPrefix(item.Name, "hosts/web/") {
+			t.Errorf("backup %q is not in the folder of the destination", item.Name)
+		}
+	}
+	if items, err := other.buildBackupsList(ctx); err != nil || len(items) != 0 {
+		t.Errorf("the destination of another folder lists %v, %v, want nothing", items, err)
+	}
+
+	var fetched bytes.Buffer
+	if err := d.fetchBackup(ctx, BackupItem{Name: "hosts/web/" + names[1]}, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	if fetched.String() != names[1] {
+		t.Errorf("fetched %q, want %q", fetched.String(), names[1])
+	}
+
+	if err := d.cleanOldBackups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	items, err = d.buildBackupsList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remaining []string
+	for _, item := range items {
+		remaining = append(remaining, item.Name)
+	}
+	sort.Strings(remaining)
+	if strings.Join(remaining, ",") != "hosts/web/"+names[1]+",hosts/web/"+names[2] {
+		t.Errorf("got %v after cleaning, want the 2 most recent backups", remaining)
+	}
+}
+
+func TestAwsDestinationObjects(t *testing.T) {
+	server, _ := newTestS3Server(t, "backups")
+	d := newTestAwsDestination(t, server.URL, "repo", &BackupTarget{Name: "docs"})
+	ctx := context.Background()
+	for _, key := range []string{"index.json", "chunks/ab/abcd", "chunks/cd/cdef"} {
+		if err := d.putObject(ctx, key, strings.NewReader(key), 0); err != nil {
+			t.Fatalf("putObject(%q): %s", key, err)
+		}
+	}
+
+	listed, err := d.listObjects(ctx, "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != "chunks/ab/abcd,chunks/cd/cdef" {
+		t.Errorf("listObjects(\"chunks\") = %v", listed)
+	}
+
+	var object bytes.Buffer
+	if err := d.getObject(ctx, "chunks/cd/cdef", &object); err != nil || object.String() != "chunks/cd/cdef" {
+		t.Errorf("getObject = %q, %v", object.String(), err)
+	}
+	if err := d.deleteObject(ctx, "index.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.getObject(ctx, "index.json", &object); err == nil {
+		t.Error("a deleted object can still be read")
+	}
+}
+
+func TestAwsDestinationMissingBucket(t *testing.T) {
+	server, _ := newTestS3Server(t, "backups")
+	d := NewBackupDestinationAws()
+	d.Endpoint = server.URL
+	d.PathStyle = true
+	d.AccessKeyId = "test"
+	d.SecretAccessKey = "test"
+	d.Bucket = "missing"
+	d.setTarget(&BackupTarget{Name: "docs"})
+	if d.init(false) {
+		t.Error("a destination with a missing bucket initialized")
+	}
+}
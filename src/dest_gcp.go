@@ -3,13 +3,14 @@ package main
 import (
 	"cloud.google.com/go/storage"
 	"context"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	"io"
-	"os"
-	"path/filepath"
+	"path"
+	"strings"
 )
 
 type BackupDestinationGcp struct {
@@ -17,74 +18,164 @@ type BackupDestinationGcp struct {
 	ready        bool
 	client       *storage.Client
 	bucketHandle *storage.BucketHandle
-	Credentials  string `mapstructure:"credentials"`
-	Folder       string `mapstructure:"folder"`
-	Bucket       string `mapstructure:"bucket"`
+	// Credentials is the service account key file, unless the application default
+	// credentials of the environment are used
+	Credentials                   string `mapstructure:"credentials"`
+	ApplicationDefaultCredentials bool   `mapstructure:"application_default_credentials"`
+	Folder                        string `mapstructure:"folder"`
+	Bucket                        string `mapstructure:"bucket"`
+	// StorageClass is the class of the stored objects, the default class of the bucket otherwise
+	StorageClass string `mapstructure:"storage_class"`
+	// KmsKeyName is the Cloud KMS key encrypting the stored objects, as
+	// 'projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>'
+	KmsKeyName string `mapstructure:"kms_key_name"`
+	// ChunkSize is the size in MiB of the chunks of resumable uploads, 16 by
+	// default. A failed chunk is retried, and each upload buffers one chunk.
+	ChunkSize int `mapstructure:"chunk_size"`
+	// Metadata are 'key=value' pairs set as custom metadata of the stored objects
+	Metadata []string `mapstructure:"metadata"`
+
+	metadata map[string]string
 }
 
+// gcpStorageClasses are the classes objects can be stored with, the last ones
+// being legacy classes still accepted by the API
+var gcpStorageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE", "MULTI_REGIONAL", "REGIONAL", "DURABLE_REDUCED_AVAILABILITY"}
+
 func NewBackupDestinationGcp() *BackupDestinationGcp {
 	return &BackupDestinationGcp{}
 }
 
-func parseConfigGcpDestination(unmarshalKey string, t *BackupTarget) {
+func parseConfigGcpDestination(unmarshalKey string, t *BackupTarget) error {
 	gcpDest := NewBackupDestinationGcp()
-	handleFatalErr(
-		viper.UnmarshalKey(unmarshalKey, &gcpDest),
-		"Cannot parse gcp backup destination %s\n",
-		unmarshalKey)
+	if err := viper.UnmarshalKey(unmarshalKey, &gcpDest); err != nil {
+		return fmt.Errorf("cannot parse gcp backup destination %s: %w", unmarshalKey, err)
+	}
 	if len(gcpDest.Credentials) > 0 {
 		gcpDest.Credentials = parseTilde(gcpDest.Credentials)
 	}
+	gcpDest.StorageClass = strings.ToUpper(gcpDest.StorageClass)
 	t.DestinationConfig = append(t.DestinationConfig, gcpDest)
+	return nil
 }
 
-func (d *BackupDestinationGcp) init() bool {
-	return false
-
-	client, err := storage.NewClient(context.TODO(), option.WithCredentialsFile(d.Credentials))
-	if handleErr(err) {
-		d.ready = false
+// init builds the client shared by every operation of the destination, then
+// checks that the bucket exists and, if checkWrite is set, accepts writes
+func (d *BackupDestinationGcp) init(checkWrite bool) bool {
+	d.ready = false
+	if handleErr(d.parseOptions(), "%s Invalid configuration", getDestLogPrefix(d)) {
 		return false
 	}
+	var clientOptions []option.ClientOption
+	if len(d.Credentials) > 0 {
+		clientOptions = append(clientOptions, option.WithCredentialsFile(d.Credentials))
+	}
+	client, err := storage.NewClient(context.Background(), clientOptions...)
+	if handleErr(err, "%s Cannot create storage client", getDestLogPrefix(d)) {
+		return false
+	}
+	d.client = client
 	d.bucketHandle = client.Bucket(d.Bucket)
+
+	ctx, cancel := context.WithTimeout(context.Background(), destinationProbeTimeout)
+	defer cancel()
+	if handleErr(d.probe(ctx, checkWrite), "%s Destination check failed", getDestLogPrefix(d)) {
+		handleWarnErr(d.close(), "%s Cannot close storage client", getDestLogPrefix(d))
+		return false
+	}
 	d.ready = true
 	return d.ready
 }
 
-func (d *BackupDestinationGcp) runBackup() {
-	client, err := storage.NewClient(context.TODO(), option.WithCredentialsFile(d.Credentials))
-	if handleErr(err) {
-		return
+func (d *BackupDestinationGcp) parseOptions() error {
+	if len(d.Bucket) == 0 {
+		return fmt.Errorf("'bucket' is required")
 	}
-	bucketHandle := client.Bucket(d.Bucket)
-	objectName := filepath.Base(d.target.Archive)
-	if len(d.Folder) > 0 {
-		objectName = filepath.Join(d.Folder, objectName)
+	if (len(d.Credentials) > 0) == d.ApplicationDefaultCredentials {
+		return fmt.Errorf("either 'credentials' or 'application_default_credentials' is required")
+	}
+	if len(d.StorageClass) > 0 && !stringInSlice(d.StorageClass, gcpStorageClasses) {
+		return fmt.Errorf("unknown storage class '%s'", d.StorageClass)
 	}
-	obj := bucketHandle.Object(objectName)
-	bucketWriter := obj.NewWriter(context.TODO())
-	archiveHandle, err := os.Open(d.target.Archive)
-	defer func() {
-		handleErr(archiveHandle.Close())
-	}()
-	if handleErr(err) {
-		return
+	if len(d.KmsKeyName) > 0 && !strings.HasPrefix(d.KmsKeyName, "projects/") {
+		return fmt.Errorf("'kms_key_name' must be the resource name of the key, starting with 'projects/'")
 	}
-	_, err = io.Copy(bucketWriter, archiveHandle)
-	if handleErr(err) {
-		return
+	if d.ChunkSize < 0 {
+		return fmt.Errorf("'chunk_size' cannot be negative")
 	}
-	if handleErr(bucketWriter.Close()) {
-		return
+	d.metadata = nil
+	for _, entry := range d.Metadata {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return fmt.Errorf("invalid metadata '%s', expected 'key=value'", entry)
+		}
+		if d.metadata == nil {
+			d.metadata = map[string]string{}
+		}
+		d.metadata[parts[0]] = parts[1]
+	}
+	return nil
+}
+
+func (d *BackupDestinationGcp) probe(ctx context.Context, checkWrite bool) error {
+	if _, err := d.bucketHandle.Attrs(ctx); err != nil {
+		return fmt.Errorf("cannot access bucket '%s': %w", d.Bucket, err)
+	}
+	if !checkWrite {
+		return nil
+	}
+	return probeDestinationWrite(ctx, d)
+}
+
+func (d *BackupDestinationGcp) close() error {
+	if d.client == nil {
+		return nil
+	}
+	err := d.client.Close()
+	d.client, d.bucketHandle = nil, nil
+	return err
+}
+
+// newObjectWriter returns the writer uploading an object with the options of
+// the destination. Cancelling ctx is the only way to abort a partial upload.
+func (d *BackupDestinationGcp) newObjectWriter(ctx context.Context, objectName string) *storage.Writer {
+	w := d.bucketHandle.Object(objectName).NewWriter(ctx)
+	w.StorageClass = d.StorageClass
+	w.KMSKeyName = d.KmsKeyName
+	w.Metadata = d.metadata
+	if d.ChunkSize > 0 {
+		w.ChunkSize = d.ChunkSize << 20
+	}
+	return w
+}
+
+// writeObject uploads the object read from r, aborting the upload on error
+func (d *BackupDestinationGcp) writeObject(ctx context.Context, objectName string, r io.Reader) error {
+	uploadCtx, cancelUpload := context.WithCancel(ctx)
+	defer cancelUpload()
+	objectWriter := d.newObjectWriter(uploadCtx, objectName)
+	if _, err := io.Copy(objectWriter, r); err != nil {
+		cancelUpload()
+		objectWriter.Close()
+		return err
+	}
+	return objectWriter.Close()
+}
+
+func (d *BackupDestinationGcp) runBackup(ctx context.Context, name string, r io.Reader, _ int64) error {
+	if err := d.writeObject(ctx, d.getObjectName(name), r); err != nil {
+		return err
 	}
 	log.Infof("%s Backup uploaded to bucket %s\n", getDestLogPrefix(d), d.Bucket)
+	return nil
 }
 
+// buildBackupsList lists the objects below the folder of the destination
 func (d *BackupDestinationGcp) buildBackupsList(ctx context.Context) ([]BackupItem, error) {
 	var backupItems []BackupItem
 
-	query := &storage.Query{}
-	err := query.SetAttrSelection([]string{"Name"})
+	query := &storage.Query{Prefix: d.getFolderPrefix()}
+	err := query.SetAttrSelection([]string{"Name", "Created", "Updated"})
 	if err != nil {
 		return nil, err
 	}
@@ -98,31 +189,90 @@ func (d *BackupDestinationGcp) buildBackupsList(ctx context.Context) ([]BackupIt
 			return nil, err
 		}
 		if doesBackupNameMatch(d.target, objectAttrs.Name) {
+			date := objectAttrs.Created
+			if date.IsZero() {
+				date = objectAttrs.Updated
+			}
 			backupItems = append(backupItems, BackupItem{
 				Name: objectAttrs.Name,
-				Date: objectAttrs.Created,
+				Date: date,
 			})
 		}
 	}
 	return backupItems, nil
 }
 
-func (d *BackupDestinationGcp) cleanOldBackups() {
-	backupItems, err := d.buildBackupsList(context.TODO())
-
-	if handleErr(err) {
-		return
+func (d *BackupDestinationGcp) fetchBackup(ctx context.Context, item BackupItem, w io.Writer) error {
+	objectReader, err := d.bucketHandle.Object(item.Name).NewReader(ctx)
+	if err != nil {
+		return err
 	}
-	sortBackups(d.target, backupItems)
+	defer objectReader.Close()
+	_, err = io.Copy(w, objectReader)
+	return err
+}
 
-	for i := 0; i < len(backupItems)-d.target.Config.KeepOnly; i++ {
-		objectHandle := d.bucketHandle.Object(backupItems[i].Name)
-		if handleErr(objectHandle.Delete(context.TODO())) {
-			return
+func (d *BackupDestinationGcp) cleanOldBackups(ctx context.Context) error {
+	backupItems, err := d.buildBackupsList(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range getBackupsToRemove(d.target, backupItems) {
+		objectHandle := d.bucketHandle.Object(item.Name)
+		if err := objectHandle.Delete(ctx); err != nil {
+			return err
 		}
-		log.Debugf("%s Removed old backup object '%s'\n", getDestLogPrefix(d), backupItems[i].Name)
+		log.Debugf("%s Removed old backup object '%s'\n", getDestLogPrefix(d), item.Name)
 	}
 	log.Infoln(getDestLogPrefix(d), "Cleaned old backups")
+	return nil
+}
+
+func (d *BackupDestinationGcp) getObjectName(key string) string {
+	if len(d.Folder) > 0 {
+		return path.Join(d.Folder, key)
+	}
+	return key
+}
+
+// getFolderPrefix returns the prefix of the names of the objects in the folder
+func (d *BackupDestinationGcp) getFolderPrefix() string {
+	if len(d.Folder) > 0 {
+		return strings.TrimSuffix(d.Folder, "/") + "/"
+	}
+	return ""
+}
+
+func (d *BackupDestinationGcp) putObject(ctx context.Context, key string, r io.Reader, _ int64) error {
+	return d.writeObject(ctx, d.getObjectName(key), r)
+}
+
+func (d *BackupDestinationGcp) getObject(ctx context.Context, key string, w io.Writer) error {
+	return d.fetchBackup(ctx, BackupItem{Name: d.getObjectName(key)}, w)
+}
+
+func (d *BackupDestinationGcp) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	folderPrefix := d.getFolderPrefix()
+	query := &storage.Query{Prefix: d.getObjectName(prefix) + "/"}
+	if err := query.SetAttrSelection([]string{"Name"}); err != nil {
+		return nil, err
+	}
+	objectIterator := d.bucketHandle.Objects(ctx, query)
+	for {
+		objectAttrs, err := objectIterator.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		keys = append(keys, strings.TrimPrefix(objectAttrs.Name, folderPrefix))
+	}
+	return keys, nil
+}
+
+func (d *BackupDestinationGcp) deleteObject(ctx context.Context, key string) error {
+	return d.bucketHandle.Object(d.getObjectName(key)).Delete(ctx)
 }
 
 func (d *BackupDestinationGcp) getName() string {
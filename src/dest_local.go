@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type BackupDestinationLocal struct {
@@ -18,30 +21,53 @@ func NewBackupDestinationLocal() *BackupDestinationLocal {
 	return &BackupDestinationLocal{}
 }
 
-func parseConfigLocalDestination(unmarshalKey string, t *BackupTarget) {
+func parseConfigLocalDestination(unmarshalKey string, t *BackupTarget) error {
 	localDest := NewBackupDestinationLocal()
-	handleFatalErr(
-		viper.UnmarshalKey(unmarshalKey, &localDest),
-		"Cannot parse local backup destination %s\n",
-		unmarshalKey)
+	if err := viper.UnmarshalKey(unmarshalKey, &localDest); err != nil {
+		return fmt.Errorf("cannot parse local backup destination %s: %w", unmarshalKey, err)
+	}
 	localDest.Directory = parseTilde(localDest.Directory)
 	t.DestinationConfig = append(t.DestinationConfig, localDest)
+	return nil
 }
 
-func (d *BackupDestinationLocal) init() bool {
+func (d *BackupDestinationLocal) init(checkWrite bool) bool {
+	if checkWrite {
+		err := probeDestinationWrite(context.Background(), d)
+		d.ready = !handleErr(err, "%s Destination check failed", getDestLogPrefix(d))
+		return d.ready
+	}
 	d.ready = true
 	return d.ready
 }
 
-func (d *BackupDestinationLocal) runBackup() {
-	localDestPath := d.Directory + "/" + filepath.Base(d.target.Archive)
-	if handleErr(os.MkdirAll(d.Directory, os.ModePerm), getDestLogPrefix(d)) {
-		return
+func (d *BackupDestinationLocal) close() error {
+	return nil
+}
+
+// uploadFile writes a file under a temporary name then renames it, so that an
+// interrupted run never leaves a truncated backup behind
+func (d *BackupDestinationLocal) uploadFile(ctx context.Context, filePath string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp")
+	_, err := writeFile(ctx, tmpPath, r)
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
 	}
-	_, err := copyFile(d.target.Archive, localDestPath)
-	if !handleErr(err, getDestLogPrefix(d)) {
-		log.Infoln(getDestLogPrefix(d), "Backup saved")
+	if err != nil {
+		handleWarnErr(os.Remove(tmpPath), "%s Cannot remove temporary file", getDestLogPrefix(d))
+	}
+	return err
+}
+
+func (d *BackupDestinationLocal) runBackup(ctx context.Context, name string, r io.Reader, _ int64) error {
+	if err := d.uploadFile(ctx, filepath.Join(d.Directory, name), r); err != nil {
+		return err
 	}
+	log.Infoln(getDestLogPrefix(d), "Backup saved")
+	return nil
 }
 
 func (d *BackupDestinationLocal) buildBackupsList(_ context.Context) ([]BackupItem, error) {
@@ -68,18 +94,69 @@ func (d *BackupDestinationLocal) buildBackupsList(_ context.Context) ([]BackupIt
 	return backupItems, nil
 }
 
-func (d *BackupDestinationLocal) cleanOldBackups() {
-	backupItems, err := d.buildBackupsList(context.TODO())
+func (d *BackupDestinationLocal) fetchBackup(_ context.Context, item BackupItem, w io.Writer) error {
+	file, err := os.Open(item.Name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
 
-	if handleErr(err, getDestLogPrefix(d)) {
-		return
+func (d *BackupDestinationLocal) cleanOldBackups(ctx context.Context) error {
+	backupItems, err := d.buildBackupsList(ctx)
+	if err != nil {
+		return err
 	}
-	sortBackups(d.target, backupItems)
-	for i := 0; i < len(backupItems)-d.target.Config.KeepOnly; i++ {
-		handleErr(os.Remove(backupItems[i].Name), getDestLogPrefix(d))
-		log.Debugf("%s Removed old backup file '%s'\n", getDestLogPrefix(d), backupItems[i].Name)
+	for _, item := range getBackupsToRemove(d.target, backupItems) {
+		if err := os.Remove(item.Name); err != nil {
+			return err
+		}
+		log.Debugf("%s Removed old backup file '%s'\n", getDestLogPrefix(d), item.Name)
 	}
 	log.Infoln(getDestLogPrefix(d), "Cleaned old backups")
+	return nil
+}
+
+func (d *BackupDestinationLocal) putObject(ctx context.Context, key string, r io.Reader, _ int64) error {
+	return d.uploadFile(ctx, filepath.Join(d.Directory, filepath.FromSlash(key)), r)
+}
+
+func (d *BackupDestinationLocal) getObject(_ context.Context, key string, w io.Writer) error {
+	file, err := os.Open(filepath.Join(d.Directory, filepath.FromSlash(key)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+func (d *BackupDestinationLocal) listObjects(_ context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.Walk(filepath.Join(d.Directory, filepath.FromSlash(prefix)), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// Skips the temporary files of uploads in progress
+		if info.IsDir() || (strings.HasPrefix(info.Name(), ".") && strings.HasSuffix(info.Name(), ".tmp")) {
+			return nil
+		}
+		key, err := filepath.Rel(d.Directory, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(key))
+		return nil
+	})
+	return keys, err
+}
+
+func (d *BackupDestinationLocal) deleteObject(_ context.Context, key string) error {
+	return os.Remove(filepath.Join(d.Directory, filepath.FromSlash(key)))
 }
 
 func (d *BackupDestinationLocal) getName() string {
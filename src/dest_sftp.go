@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSftpPort    = 22
+	defaultSftpTimeout = 30 * time.Second
+)
+
+type BackupDestinationSftp struct {
+	ready    bool
+	target   *BackupTarget
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	User     string `mapstructure:"user"`
+	KeyFile  string `mapstructure:"key_file"`
+	Password string `mapstructure:"password"`
+	// KnownHosts is the file the host key is checked against, ~/.ssh/known_hosts by default
+	KnownHosts string        `mapstructure:"known_hosts"`
+	Directory  string        `mapstructure:"directory"`
+	Timeout    time.Duration `mapstructure:"timeout"`
+
+	sshConfig *ssh.ClientConfig
+	// The connection is opened on first use and shared by the runs of the target,
+	// then opened again if the server closed it
+	mu        sync.Mutex
+	sshClient *ssh.Client
+	client    *sftp.Client
+}
+
+func NewBackupDestinationSftp() *BackupDestinationSftp {
+	return &BackupDestinationSftp{}
+}
+
+func parseConfigSftpDestination(unmarshalKey string, t *BackupTarget) error {
+	sftpDest := NewBackupDestinationSftp()
+	if err := viper.UnmarshalKey(unmarshalKey, &sftpDest); err != nil {
+		return fmt.Errorf("cannot parse sftp backup destination %s: %w", unmarshalKey, err)
+	}
+	if sftpDest.Port == 0 {
+		sftpDest.Port = defaultSftpPort
+	}
+	if sftpDest.Timeout == 0 {
+		sftpDest.Timeout = defaultSftpTimeout
+	}
+	if len(sftpDest.KnownHosts) == 0 {
+		sftpDest.KnownHosts = "~/.ssh/known_hosts"
+	}
+	sftpDest.KnownHosts = parseTilde(sftpDest.KnownHosts)
+	if len(sftpDest.KeyFile) > 0 {
+		sftpDest.KeyFile = parseTilde(sftpDest.KeyFile)
+	}
+	t.DestinationConfig = append(t.DestinationConfig, sftpDest)
+	return nil
+}
+
+func (d *BackupDestinationSftp) getSshConfig() (*ssh.ClientConfig, error) {
+	if len(d.Host) == 0 || len(d.User) == 0 || len(d.Directory) == 0 {
+		return nil, fmt.Errorf("'host', 'user' and 'directory' are required")
+	}
+	var auth []ssh.AuthMethod
+	if len(d.KeyFile) > 0 {
+		key, err := ioutil.ReadFile(d.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key file: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse key file: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if len(d.Password) > 0 {
+		auth = append(auth, ssh.Password(d.Password))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("'key_file' or 'password' is required")
+	}
+	hostKeyCallback, err := knownhosts.New(d.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read known hosts: %w", err)
+	}
+	return &ssh.ClientConfig{
+		User:            d.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         d.Timeout,
+	}, nil
+}
+
+// init connects to the server, then checks that the directory exists and, if
+// checkWrite is set, accepts writes
+func (d *BackupDestinationSftp) init(checkWrite bool) bool {
+	var err error
+	d.ready = false
+	d.sshConfig, err = d.getSshConfig()
+	if handleErr(err, "%s Invalid configuration", getDestLogPrefix(d)) {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), destinationProbeTimeout)
+	defer cancel()
+	d.ready = !handleErr(d.probe(ctx, checkWrite), "%s Destination check failed", getDestLogPrefix(d))
+	return d.ready
+}
+
+func (d *BackupDestinationSftp) probe(ctx context.Context, checkWrite bool) error {
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot connect to %s: %w", d.Host, err)
+	}
+	if checkWrite {
+		// The directory is created by the first upload
+		return probeDestinationWrite(ctx, d)
+	}
+	info, err := client.Stat(d.Directory)
+	if err != nil {
+		return fmt.Errorf("cannot access directory '%s': %w", d.Directory, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", d.Directory)
+	}
+	return nil
+}
+
+// getClient returns the SFTP session, connecting to the server if needed
+func (d *BackupDestinationSftp) getClient(ctx context.Context) (*sftp.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	addr := net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+	dialer := net.Dialer{Timeout: d.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The SSH handshake and the start of the SFTP session have no timeout of
+	// their own, a server stalling them would hang the run
+	if d.Timeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(d.Timeout)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, d.sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		client.Close()
+		sshClient.Close()
+		return nil, err
+	}
+	go func() {
+		sshClient.Wait()
+		d.mu.Lock()
+		if d.sshClient == sshClient {
+			d.client, d.sshClient = nil, nil
+		}
+		d.mu.Unlock()
+	}()
+	d.sshClient, d.client = sshClient, client
+	log.Debugf("%s Connected to %s\n", getDestLogPrefix(d), addr)
+	return client, nil
+}
+
+// close ends the session to the server, a later operation connecting again
+func (d *BackupDestinationSftp) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.client == nil {
+		return nil
+	}
+	err := d.client.Close()
+	if sshErr := d.sshClient.Close(); err == nil {
+		err = sshErr
+	}
+	d.client, d.sshClient = nil, nil
+	return err
+}
+
+// uploadFile writes a remote file under a temporary name then renames it, so
+// that an interrupted upload never leaves a truncated file behind
+func (d *BackupDestinationSftp) uploadFile(ctx context.Context, client *sftp.Client, remotePath string, r io.Reader) error {
+	if err := client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+	tmpPath := path.Join(path.Dir(remotePath), "."+path.Base(remotePath)+".tmp")
+	file, err := client.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, contextReader{ctx: ctx, r: r})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameRemoteFile(client, tmpPath, remotePath)
+	}
+	if err != nil {
+		handleWarnErr(client.Remove(tmpPath), "%s Cannot remove temporary file", getDestLogPrefix(d))
+	}
+	return err
+}
+
+// renameRemoteFile replaces newPath atomically when the server supports it,
+// since a plain SFTP rename fails if the file exists
+func renameRemoteFile(client *sftp.Client, oldPath string, newPath string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(oldPath, newPath)
+	}
+	if err := client.Remove(newPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return client.Rename(oldPath, newPath)
+}
+
+func (d *BackupDestinationSftp) runBackup(ctx context.Context, name string, r io.Reader, _ int64) error {
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := d.uploadFile(ctx, client, path.Join(d.Directory, name), r); err != nil {
+		return err
+	}
+	log.Infoln(getDestLogPrefix(d), "Backup saved")
+	return nil
+}
+
+func (d *BackupDestinationSftp) buildBackupsList(ctx context.Context) ([]BackupItem, error) {
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var backupItems []BackupItem
+	walker := client.Walk(d.Directory)
+	for walker.Step() {
+		if err := walker.Err(); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		info := walker.Stat()
+		if info.Mode().IsRegular() && doesBackupNameMatch(d.target, info.Name()) {
+			backupItems = append(backupItems, BackupItem{
+				Name: walker.Path(),
+				Date: info.ModTime(),
+			})
+		}
+	}
+	return backupItems, nil
+}
+
+func (d *BackupDestinationSftp) fetchBackup(ctx context.Context, item BackupItem, w io.Writer) error {
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	file, err := client.Open(item.Name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, contextReader{ctx: ctx, r: file})
+	return err
+}
+
+func (d *BackupDestinationSftp) cleanOldBackups(ctx context.Context) error {
+	backupItems, err := d.buildBackupsList(ctx)
+	if err != nil {
+		return err
+	}
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range getBackupsToRemove(d.target, backupItems) {
+		if err := client.Remove(item.Name); err != nil {
+			return err
+		}
+		log.Debugf("%s Removed old backup file '%s'\n", getDestLogPrefix(d), item.Name)
+	}
+	log.Infoln(getDestLogPrefix(d), "Cleaned old backups")
+	return nil
+}
+
+func (d *BackupDestinationSftp) putObject(ctx context.Context, key string, r io.Reader, _ int64) error {
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	return d.uploadFile(ctx, client, path.Join(d.Directory, key), r)
+}
+
+func (d *BackupDestinationSftp) getObject(ctx context.Context, key string, w io.Writer) error {
+	return d.fetchBackup(ctx, BackupItem{Name: path.Join(d.Directory, key)}, w)
+}
+
+func (d *BackupDestinationSftp) listObjects(ctx context.Context, prefix string) ([]string, error) {
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	walker := client.Walk(path.Join(d.Directory, prefix))
+	for walker.Step() {
+		if err := walker.Err(); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		// Skips the directories and the temporary files of uploads in progress
+		name := path.Base(walker.Path())
+		if walker.Stat().IsDir() || (strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp")) {
+			continue
+		}
+		keys = append(keys, strings.TrimPrefix(walker.Path(), strings.TrimSuffix(d.Directory, "/")+"/"))
+	}
+	return keys, nil
+}
+
+func (d *BackupDestinationSftp) deleteObject(ctx context.Context, key string) error {
+	client, err := d.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	return client.Remove(path.Join(d.Directory, key))
+}
+
+func (d *BackupDestinationSftp) getName() string {
+	return "sftp"
+}
+
+func (d *BackupDestinationSftp) setTarget(ptr *BackupTarget) {
+	d.target = ptr
+}
+
+func (d *BackupDestinationSftp) getTarget() *BackupTarget {
+	return d.target
+}
+
+func (d *BackupDestinationSftp) isReady() bool {
+	return d.ready
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSftpDestination returns a destination connected to an in-process SFTP
+// server, serving the local file system without SSH
+func newTestSftpDestination(t *testing.T, target *BackupTarget) *BackupDestinationSftp {
+	dir, err := ioutil.TempDir("", "autobackup_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closing the server first ends the reads the client waits for
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	d := NewBackupDestinationSftp()
+	d.Host = "localhost"
+	d.Directory = filepath.ToSlash(filepath.Join(dir, "backups"))
+	d.client = client
+	d.setTarget(target)
+	return d
+}
+
+func TestSftpDestinationBackups(t *testing.T) {
+	target := &BackupTarget{Name: "docs", Ext: ".tar.gz", Config: BackupTargetConfig{DateSuffix: true, KeepOnly: 2}}
+	d := newTestSftpDestination(t, target)
+	ctx := context.Background()
+	client, err := d.getClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.probe(ctx, true); err != nil {
+		t.Fatalf("write probe failed: %s", err)
+	}
+
+	names := []string{"docs_20240101_000000.tar.gz", "docs_20240102_000000.tar.gz", "docs_20240103_000000.tar.gz"}
+	for i, name := range names {
+		if err := d.runBackup(ctx, name, strings.NewReader(name), 0); err != nil {
+			t.Fatalf("runBackup(%q): %s", name, err)
+		}
+		// Orders the backups, the server keeping mtimes to the second
+		date := time.Date(2024, 1, i+1, 0, 0, 0, 0, time.UTC)
+		if err := client.Chtimes(path.Join(d.Directory, name), date, date); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Uploading again replaces the file through the rename
+	if err := d.runBackup(ctx, names[2], strings.NewReader("replaced"), 0); err != nil {
+		t.Fatalf("runBackup over an existing file: %s", err)
+	}
+	// Files of other targets and temporary files are not backups
+	if err := d.putObject(ctx, "other_20240101_000000.tar.gz", strings.NewReader("other"), 0); err != nil {
+		t.Fatal(err)
+	}
+	tmpFile, err := client.Create(path.Join(d.Directory, ".docs_20240104_000000.tar.gz.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+
+	items, err := d.buildBackupsList(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("got %d backups, want 3: %v", len(items), items)
+	}
+	var fetched bytes.Buffer
+	if err := d.fetchBackup(ctx, BackupItem{Name: path.Join(d.Directory, names[2])}, &fetched); err != nil {
+		t.Fatal(err)
+	}
+	if fetched.String() != "replaced" {
+		t.Errorf("fetched %q, want the replaced content", fetched.String())
+	}
+
+	if err := d.cleanOldBackups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Stat(path.Join(d.Directory, names[0])); !os.IsNotExist(err) {
+		t.Errorf("the oldest backup was not removed: %v", err)
+	}
+	if items, err := d.buildBackupsList(ctx); err != nil || len(items) != 2 {
+		t.Errorf("got %d backups after cleaning, want 2 (%v)", len(items), err)
+	}
+}
+
+func TestSftpDestinationObjects(t *testing.T) {
+	d := newTestSftpDestination(t, &BackupTarget{Name: "docs"})
+	ctx := context.Background()
+	keys := []string{"index.json", "chunks/ab/abcd", "chunks/cd/cdef"}
+	for _, key := range keys {
+		if err := d.putObject(ctx, key, strings.NewReader(key), 0); err != nil {
+			t.Fatalf("putObject(%q): %s", key, err)
+		}
+	}
+	client, err := d.getClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile, err := client.Create(path.Join(d.Directory, "chunks/ab/.abff.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpFile.Close()
+
+	listed, err := d.listObjects(ctx, "chunks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(listed)
+	if strings.Join(listed, ",") != "chunks/ab/abcd,chunks/cd/cdef" {
+		t.Errorf("listObjects(\"chunks\") = %v", listed)
+	}
+	if listed, err := d.listObjects(ctx, "missing"); err != nil || len(listed) != 0 {
+		t.Errorf("listObjects of a missing prefix = %v, %v, want nothing", listed, err)
+	}
+
+	var object bytes.Buffer
+	if err := d.getObject(ctx, "chunks/cd/cdef", &object); err != nil || object.String() != "chunks/cd/cdef" {
+		t.Errorf("getObject = %q, %v", object.String(), err)
+	}
+	if err := d.deleteObject(ctx, "index.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.getObject(ctx, "index.json", ioutil.Discard); err == nil {
+		t.Error("a deleted object can still be read")
+	}
+}
+
+func TestSftpDestinationHandshakeTimeout(t *testing.T) {
+	// A server accepting connections but never answering the handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	d := NewBackupDestinationSftp()
+	addr := listener.Addr().(*net.TCPAddr)
+	d.Host, d.Port = addr.IP.String(), addr.Port
+	d.Timeout = 200 * time.Millisecond
+	d.sshConfig = &ssh.ClientConfig{
+		User:            "test",
+		Auth:            []ssh.AuthMethod{ssh.Password("test")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.getClient(context.Background())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("connected to a server never answering")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the handshake with a stalled server does not time out")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"filippo.io/age"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const encryptedArchiveExt = ".age"
+
+type EncryptionConfig struct {
+	Recipients     []string `mapstructure:"recipients"`
+	RecipientsFile string   `mapstructure:"recipients_file"`
+	PassphraseFile string   `mapstructure:"passphrase_file"`
+}
+
+func (c EncryptionConfig) enabled() bool {
+	return len(c.Recipients) > 0 || len(c.RecipientsFile) > 0 || len(c.PassphraseFile) > 0
+}
+
+func readPassphraseFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(parseTilde(path))
+	if err != nil {
+		return "", fmt.Errorf("cannot read passphrase file: %w", err)
+	}
+	passphrase := strings.TrimRight(string(content), "\r\n")
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("passphrase file %s is empty", path)
+	}
+	return passphrase, nil
+}
+
+// getEncryptionRecipients returns the age recipients archives are encrypted to,
+// either public keys or a single passphrase
+func getEncryptionRecipients(c EncryptionConfig) ([]age.Recipient, error) {
+	hasKeys := len(c.Recipients) > 0 || len(c.RecipientsFile) > 0
+	if hasKeys && len(c.PassphraseFile) > 0 {
+		return nil, fmt.Errorf("encryption 'passphrase_file' cannot be combined with recipients")
+	}
+	if len(c.PassphraseFile) > 0 {
+		passphrase, err := readPassphraseFile(c.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{recipient}, nil
+	}
+
+	var recipients []age.Recipient
+	for _, publicKey := range c.Recipients {
+		recipient, err := age.ParseX25519Recipient(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption recipient '%s': %w", publicKey, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(c.RecipientsFile) > 0 {
+		content, err := ioutil.ReadFile(parseTilde(c.RecipientsFile))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read recipients file: %w", err)
+		}
+		fileRecipients, err := age.ParseRecipients(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipients file %s: %w", c.RecipientsFile, err)
+		}
+		recipients = append(recipients, fileRecipients...)
+	}
+	return recipients, nil
+}
+
+// getDecryptionIdentities returns the identities from an age identity file, or
+// the passphrase of the target when no identity file is given
+func getDecryptionIdentities(t *BackupTarget, identityFile string) ([]age.Identity, error) {
+	if len(identityFile) > 0 {
+		file, err := os.Open(parseTilde(identityFile))
+		if err != nil {
+			return nil, fmt.Errorf("cannot open identity file: %w", err)
+		}
+		defer file.Close()
+		identities, err := age.ParseIdentities(file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file %s: %w", identityFile, err)
+		}
+		return identities, nil
+	}
+	if len(t.Config.Encryption.PassphraseFile) > 0 {
+		passphrase, err := readPassphraseFile(t.Config.Encryption.PassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Identity{identity}, nil
+	}
+	return nil, fmt.Errorf("the backup is encrypted, an identity file is required to restore it")
+}
+
+// newArchiveEncryptor wraps w so that everything written is encrypted, or returns
+// nil if encryption is disabled for the target
+func newArchiveEncryptor(t *BackupTarget, w io.Writer) (io.WriteCloser, error) {
+	if !t.Config.Encryption.enabled() {
+		return nil, nil
+	}
+	recipients, err := getEncryptionRecipients(t.Config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return age.Encrypt(w, recipients...)
+}
+
+func isArchiveEncrypted(archiveName string) bool {
+	return strings.HasSuffix(archiveName, encryptedArchiveExt)
+}
+
+func newArchiveDecryptor(t *BackupTarget, r io.Reader, identityFile string) (io.Reader, error) {
+	identities, err := getDecryptionIdentities(t, identityFile)
+	if err != nil {
+		return nil, err
+	}
+	return age.Decrypt(r, identities...)
+}
@@ -1,32 +1,33 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"os"
 )
 
-func copyFile(src, dst string) (int64, error) {
-	sourceFileStat, err := os.Stat(src)
-	if err != nil {
-		return 0, err
-	}
-
-	if !sourceFileStat.Mode().IsRegular() {
-		return 0, fmt.Errorf("%s is not a regular file", src)
-	}
+// contextReader stops reading from the underlying reader as soon as its context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
 
-	source, err := os.Open(src)
-	if err != nil {
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
 		return 0, err
 	}
-	defer source.Close()
+	return cr.r.Read(p)
+}
 
+func writeFile(ctx context.Context, dst string, r io.Reader) (int64, error) {
 	destination, err := os.Create(dst)
 	if err != nil {
 		return 0, err
 	}
-	defer destination.Close()
-	nBytes, err := io.Copy(destination, source)
-	return nBytes, err
+	nBytes, err := io.Copy(destination, contextReader{ctx: ctx, r: r})
+	if err != nil {
+		destination.Close()
+		return nBytes, err
+	}
+	return nBytes, destination.Close()
 }
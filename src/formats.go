@@ -0,0 +1,345 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+type ArchiveFormat struct {
+	Name string
+	Ext  string
+	// RawExt is the extension of a single file compressed without archive, empty
+	// if the format has no compression
+	RawExt string
+	// MaxLevel is the highest compression level accepted, 0 if levels are not supported
+	MaxLevel        int
+	newCompressor   func(w io.Writer, level int) (io.WriteCloser, error)
+	newDecompressor func(r io.Reader) (io.ReadCloser, error)
+	zip             bool
+}
+
+var archiveFormats = []*ArchiveFormat{
+	{
+		Name: "tar",
+		Ext:  ".tar",
+	},
+	{
+		Name:     "tar.gz",
+		Ext:      ".tar.gz",
+		RawExt:   ".gz",
+		MaxLevel: gzip.BestCompression,
+		newCompressor: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		newDecompressor: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		Name:     "tar.zst",
+		Ext:      ".tar.zst",
+		RawExt:   ".zst",
+		MaxLevel: 22,
+		newCompressor: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				return zstd.NewWriter(w)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		newDecompressor: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+	{
+		Name:   "tar.xz",
+		Ext:    ".tar.xz",
+		RawExt: ".xz",
+		newCompressor: func(w io.Writer, _ int) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+		newDecompressor: func(r io.Reader) (io.ReadCloser, error) {
+			xzReader, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(xzReader), nil
+		},
+	},
+	{
+		Name:     "zip",
+		Ext:      ".zip",
+		MaxLevel: flate.BestCompression,
+		zip:      true,
+	},
+}
+
+var archiveFormatAliases = map[string]string{
+	"":           "tar.gz",
+	"compressed": "tar.gz",
+	"gzip":       "tar.gz",
+	"tgz":        "tar.gz",
+	"zstd":       "tar.zst",
+	"xz":         "tar.xz",
+}
+
+func getArchiveFormat(name string) (*ArchiveFormat, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := archiveFormatAliases[name]; ok {
+		name = alias
+	}
+	for _, format := range archiveFormats {
+		if format.Name == name {
+			return format, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown archive format '%s'", name)
+}
+
+// detectArchiveFormat finds the format of an archive from its file name, encrypted
+// or not, trying the longest extensions first so that '.tar.gz' is not mistaken
+// for '.tar'
+func detectArchiveFormat(archiveName string) (*ArchiveFormat, error) {
+	archiveName = strings.TrimSuffix(archiveName, encryptedArchiveExt)
+	formats := make([]*ArchiveFormat, len(archiveFormats))
+	copy(formats, archiveFormats)
+	sort.SliceStable(formats, func(i, j int) bool {
+		return len(formats[i].Ext) > len(formats[j].Ext)
+	})
+	for _, format := range formats {
+		if strings.HasSuffix(archiveName, format.Ext) {
+			return format, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot detect the archive format of '%s'", archiveName)
+}
+
+// detectRawFormat finds the compression of a single file stored without archive
+// from its file name, encrypted or not
+func detectRawFormat(fileName string) (*ArchiveFormat, error) {
+	fileName = strings.TrimSuffix(fileName, encryptedArchiveExt)
+	for _, format := range archiveFormats {
+		if len(format.RawExt) > 0 && strings.HasSuffix(fileName, format.RawExt) {
+			return format, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot detect the compression of '%s'", fileName)
+}
+
+func validateCompressionLevel(format *ArchiveFormat, level int) error {
+	if level == 0 {
+		return nil
+	}
+	if format.MaxLevel == 0 {
+		return fmt.Errorf("format '%s' does not support 'compression_level'", format.Name)
+	}
+	if level < 1 || level > format.MaxLevel {
+		return fmt.Errorf("'compression_level' of format '%s' must be between 1 and %d", format.Name, format.MaxLevel)
+	}
+	return nil
+}
+
+// archiveWriter adds entries to an archive. Entries are described with tar
+// headers whatever the format, tar being the richest one.
+type archiveWriter interface {
+	writeEntry(header *tar.Header, content io.Reader) error
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	tarWriter  *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (aw *tarArchiveWriter) writeEntry(header *tar.Header, content io.Reader) error {
+	if err := aw.tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if content != nil {
+		if _, err := io.Copy(aw.tarWriter, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (aw *tarArchiveWriter) Close() error {
+	err := aw.tarWriter.Close()
+	if aw.compressor != nil {
+		if closeErr := aw.compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+type zipArchiveWriter struct {
+	zipWriter *zip.Writer
+}
+
+func (aw *zipArchiveWriter) writeEntry(header *tar.Header, content io.Reader) error {
+	zipHeader, err := zip.FileInfoHeader(header.FileInfo())
+	if err != nil {
+		return err
+	}
+	zipHeader.Name = header.Name
+	if header.Typeflag == tar.TypeDir {
+		zipHeader.Name = strings.TrimSuffix(zipHeader.Name, "/") + "/"
+	} else {
+		zipHeader.Method = zip.Deflate
+	}
+	entryWriter, err := aw.zipWriter.CreateHeader(zipHeader)
+	if err != nil {
+		return err
+	}
+	// Zip stores the target of a symlink as its content
+	if header.Typeflag == tar.TypeSymlink {
+		_, err = io.WriteString(entryWriter, header.Linkname)
+		return err
+	}
+	if content != nil {
+		if _, err := io.Copy(entryWriter, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (aw *zipArchiveWriter) Close() error {
+	return aw.zipWriter.Close()
+}
+
+func newArchiveWriter(format *ArchiveFormat, level int, w io.Writer) (archiveWriter, error) {
+	if format.zip {
+		zipWriter := zip.NewWriter(w)
+		if level != 0 {
+			zipWriter.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+				return flate.NewWriter(out, level)
+			})
+		}
+		return &zipArchiveWriter{zipWriter: zipWriter}, nil
+	}
+	if format.newCompressor == nil {
+		return &tarArchiveWriter{tarWriter: tar.NewWriter(w)}, nil
+	}
+	compressor, err := format.newCompressor(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchiveWriter{tarWriter: tar.NewWriter(compressor), compressor: compressor}, nil
+}
+
+// archiveReader iterates over the entries of an archive, described as tar headers
+type archiveReader interface {
+	next() (*tar.Header, io.Reader, error)
+	Close() error
+}
+
+type tarArchiveReader struct {
+	tarReader    *tar.Reader
+	decompressor io.ReadCloser
+}
+
+func (ar *tarArchiveReader) next() (*tar.Header, io.Reader, error) {
+	header, err := ar.tarReader.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	return header, ar.tarReader, nil
+}
+
+func (ar *tarArchiveReader) Close() error {
+	if ar.decompressor != nil {
+		return ar.decompressor.Close()
+	}
+	return nil
+}
+
+// zipArchiveReader reads a zip archive spooled to a temporary file, since zip
+// archives can only be read with random access
+type zipArchiveReader struct {
+	spoolFile *os.File
+	zipReader *zip.Reader
+	index     int
+	current   io.ReadCloser
+}
+
+func (ar *zipArchiveReader) next() (*tar.Header, io.Reader, error) {
+	if ar.current != nil {
+		ar.current.Close()
+		ar.current = nil
+	}
+	if ar.index >= len(ar.zipReader.File) {
+		return nil, nil, io.EOF
+	}
+	file := ar.zipReader.File[ar.index]
+	ar.index++
+	header, err := tar.FileInfoHeader(file.FileInfo(), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	header.Name = file.Name
+	header.ModTime = file.Modified
+	if ar.current, err = file.Open(); err != nil {
+		return nil, nil, err
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		link, err := ioutil.ReadAll(ar.current)
+		if err != nil {
+			return nil, nil, err
+		}
+		header.Linkname = string(link)
+	}
+	return header, ar.current, nil
+}
+
+func (ar *zipArchiveReader) Close() error {
+	if ar.current != nil {
+		ar.current.Close()
+	}
+	ar.spoolFile.Close()
+	return os.Remove(ar.spoolFile.Name())
+}
+
+func newArchiveReader(format *ArchiveFormat, r io.Reader) (archiveReader, error) {
+	if format.zip {
+		spoolFile, err := ioutil.TempFile(os.TempDir(), "autobackup_restore_*.zip")
+		if err != nil {
+			return nil, err
+		}
+		size, err := io.Copy(spoolFile, r)
+		if err == nil {
+			var zipReader *zip.Reader
+			if zipReader, err = zip.NewReader(spoolFile, size); err == nil {
+				return &zipArchiveReader{spoolFile: spoolFile, zipReader: zipReader}, nil
+			}
+		}
+		spoolFile.Close()
+		os.Remove(spoolFile.Name())
+		return nil, err
+	}
+	if format.newDecompressor == nil {
+		return &tarArchiveReader{tarReader: tar.NewReader(r)}, nil
+	}
+	decompressor, err := format.newDecompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchiveReader{tarReader: tar.NewReader(decompressor), decompressor: decompressor}, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = 5 * time.Minute
+
+const (
+	preHookStage       = "pre"
+	postHookStage      = "post"
+	onFailureHookStage = "on_failure"
+)
+
+// HookConfig is a shell command run around the backups of a target
+type HookConfig struct {
+	Command string        `mapstructure:"command"`
+	Timeout time.Duration `mapstructure:"timeout"`
+	// ContinueOnError lets the backup run even though this pre hook failed
+	ContinueOnError bool `mapstructure:"continue_on_error"`
+}
+
+// stringToHookConfigHook lets hooks be plain commands instead of tables
+func stringToHookConfigHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(HookConfig{}) {
+		return data, nil
+	}
+	return HookConfig{Command: data.(string)}, nil
+}
+
+func validateHooks(hooks []HookConfig, setting string) error {
+	for _, hook := range hooks {
+		if len(strings.TrimSpace(hook.Command)) == 0 {
+			return fmt.Errorf("empty command in '%s'", setting)
+		}
+		if hook.Timeout < 0 {
+			return fmt.Errorf("negative timeout in '%s'", setting)
+		}
+	}
+	return nil
+}
+
+// commandLogWriter logs every line written by a command
+type commandLogWriter struct {
+	prefix string
+	buf    bytes.Buffer
+}
+
+func (w *commandLogWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Incomplete line, kept until the rest is written
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		log.Infof("%s %s\n", w.prefix, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+func (w *commandLogWriter) flush() {
+	if w.buf.Len() > 0 {
+		log.Infof("%s %s\n", w.prefix, w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+// getHookEnv describes the run to the hooks with environment variables
+func getHookEnv(t *BackupTarget, stage string, result *BackupRunResult) []string {
+	env := append(os.Environ(),
+		"AUTOBACKUP_TARGET="+t.Name,
+		"AUTOBACKUP_HOOK="+stage,
+		"AUTOBACKUP_ARCHIVE="+result.Archive,
+	)
+	if len(t.Archive) > 0 {
+		env = append(env, "AUTOBACKUP_ARCHIVE_PATH="+t.Archive)
+	}
+	if stage == preHookStage {
+		return env
+	}
+
+	status := "success"
+	if result.failed() {
+		status = "failure"
+	}
+	env = append(env,
+		"AUTOBACKUP_STATUS="+status,
+		"AUTOBACKUP_FILES="+strconv.Itoa(result.Files),
+		"AUTOBACKUP_BYTES="+strconv.FormatInt(result.Bytes, 10),
+	)
+	if result.Err != nil {
+		env = append(env, "AUTOBACKUP_ERROR="+result.Err.Error())
+	}
+	var destinations []string
+	for _, destResult := range result.Destinations {
+		destStatus := "ok"
+		if destResult.Err != nil {
+			destStatus = "failed"
+			env = append(env, fmt.Sprintf("AUTOBACKUP_DEST_%s_ERROR=%s", strings.ToUpper(destResult.Destination), destResult.Err.Error()))
+		}
+		destinations = append(destinations, destResult.Destination+"="+destStatus)
+		env = append(env, fmt.Sprintf("AUTOBACKUP_DEST_%s=%s", strings.ToUpper(destResult.Destination), destStatus))
+	}
+	return append(env, "AUTOBACKUP_DESTINATIONS="+strings.Join(destinations, " "))
+}
+
+func runHook(ctx context.Context, t *BackupTarget, stage string, hook HookConfig, result *BackupRunResult) error {
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+	hookCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	log.Infof("[%s] Running %s hook '%s'\n", t.Name, stage, hook.Command)
+	output := &commandLogWriter{prefix: fmt.Sprintf("[%s][%s hook]", t.Name, stage)}
+	cmd := newShellCommand(hook.Command)
+	cmd.Env = getHookEnv(t, stage, result)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	err := runCommand(hookCtx, cmd)
+	output.flush()
+	if hookCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	return err
+}
+
+// runHooks runs the hooks of a stage in order. A failing pre hook aborts the
+// run unless it has 'continue_on_error', other failures are only logged.
+func runHooks(ctx context.Context, t *BackupTarget, stage string, hooks []HookConfig, result *BackupRunResult) error {
+	for _, hook := range hooks {
+		err := runHook(ctx, t, stage, hook, result)
+		if err == nil {
+			continue
+		}
+		if stage == preHookStage && !hook.ContinueOnError {
+			return fmt.Errorf("pre hook '%s' failed: %w", hook.Command, err)
+		}
+		log.Errorf("[%s] %s hook '%s' failed: %s\n", t.Name, stage, hook.Command, err.Error())
+	}
+	return nil
+}
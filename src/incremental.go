@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// manifestEntryName is the archive entry holding the manifest of an incremental target
+	manifestEntryName = ".autobackup-manifest.json"
+	// incrementalArchiveMarker is inserted before the extension of incremental archives
+	incrementalArchiveMarker = ".incr"
+	defaultFullEvery         = 7
+)
+
+// manifestDir is where the manifest of the last backup of each incremental target
+// is kept, to find the files changed since then
+var manifestDir string
+
+type ManifestFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Hash    string    `json:"sha256"`
+}
+
+// BackupManifest lists every file of the target at the time of a backup, and the
+// files deleted since the previous backup of the chain
+type BackupManifest struct {
+	Target      string                   `json:"target"`
+	Archive     string                   `json:"archive"`
+	Full        bool                     `json:"full"`
+	Parent      string                   `json:"parent,omitempty"`
+	ChainLength int                      `json:"chain_length"`
+	Created     time.Time                `json:"created"`
+	Files       map[string]*ManifestFile `json:"files"`
+	Deleted     []string                 `json:"deleted,omitempty"`
+}
+
+func getManifestPath(t *BackupTarget) string {
+	return filepath.Join(manifestDir, t.Name+".json")
+}
+
+func loadLastManifest(t *BackupTarget) (*BackupManifest, error) {
+	content, err := ioutil.ReadFile(getManifestPath(t))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("cannot decode manifest %s: %w", getManifestPath(t), err)
+	}
+	return manifest, nil
+}
+
+func saveLastManifest(t *BackupTarget, manifest *BackupManifest) error {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(manifestDir, 0700); err != nil {
+		return err
+	}
+	tmpPath := getManifestPath(t) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, getManifestPath(t))
+}
+
+func getFullEvery(t *BackupTarget) int {
+	if t.Config.FullEvery > 0 {
+		return t.Config.FullEvery
+	}
+	return defaultFullEvery
+}
+
+// planIncrementalBackup builds the manifest of the next backup and returns the
+// files to archive: all of them for a full backup, only the new and changed ones
+// otherwise. A full backup is done when there is no previous manifest or when
+// the chain reached 'full_every' backups.
+func planIncrementalBackup(t *BackupTarget, files []string, now time.Time) ([]string, *BackupManifest) {
+	previous, err := loadLastManifest(t)
+	if handleWarnErr(err, "[%s] Ignoring last manifest, doing a full backup", t.Name) {
+		previous = nil
+	}
+	manifest := &BackupManifest{
+		Target:      t.Name,
+		Full:        previous == nil || previous.ChainLength >= getFullEvery(t),
+		ChainLength: 1,
+		Created:     now,
+		Files:       make(map[string]*ManifestFile, len(files)),
+	}
+	if !manifest.Full {
+		manifest.Parent = previous.Archive
+		manifest.ChainLength = previous.ChainLength + 1
+	}
+
+	var changed []string
+	for _, f := range files {
+		info, err := os.Lstat(f)
+		if err != nil {
+			log.Warnf("[%s] Skipping file: %s\n", t.Name, err.Error())
+			continue
+		}
+		entryName := getArchiveEntryName(t, f)
+		entry := &ManifestFile{Size: info.Size(), ModTime: info.ModTime()}
+		manifest.Files[entryName] = entry
+		if !manifest.Full {
+			if previousEntry, ok := previous.Files[entryName]; ok &&
+				previousEntry.Size == entry.Size && previousEntry.ModTime.Equal(entry.ModTime) {
+				// Unchanged files keep the hash computed when they were archived
+				entry.Hash = previousEntry.Hash
+				continue
+			}
+		}
+		changed = append(changed, f)
+	}
+	if !manifest.Full {
+		for entryName := range previous.Files {
+			if _, ok := manifest.Files[entryName]; !ok {
+				manifest.Deleted = append(manifest.Deleted, entryName)
+			}
+		}
+		sort.Strings(manifest.Deleted)
+		log.Infof("[%s] Incremental backup %d/%d: %d changed file(s), %d deleted\n",
+			t.Name, manifest.ChainLength, getFullEvery(t), len(changed), len(manifest.Deleted))
+	} else {
+		log.Infof("[%s] Full backup of %d file(s)\n", t.Name, len(changed))
+	}
+	return changed, manifest
+}
+
+func isIncrementalArchive(archiveName string) bool {
+	return strings.Contains(filepath.Base(archiveName), incrementalArchiveMarker+".")
+}
+
+// getRestoreChain returns the backups to replay in order to restore the backup at
+// index, following the parents recorded in the manifests of incremental backups
+// back to a full backup. The archive of a run whose manifest was not saved, as
+// when a destination failed, is not the parent of any backup and is left out.
+func getRestoreChain(backupItems []BackupItem, index int, readManifest func(BackupItem) (*BackupManifest, error)) ([]BackupItem, error) {
+	byName := make(map[string]BackupItem, index+1)
+	for _, item := range backupItems[:index+1] {
+		byName[filepath.Base(item.Name)] = item
+	}
+	chain := []BackupItem{backupItems[index]}
+	for item := backupItems[index]; isIncrementalArchive(item.Name); item = chain[len(chain)-1] {
+		if len(chain) > index+1 {
+			return nil, fmt.Errorf("the parents of '%s' form a cycle", filepath.Base(backupItems[index].Name))
+		}
+		manifest, err := readManifest(item)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the manifest of '%s': %w", filepath.Base(item.Name), err)
+		}
+		if manifest == nil || len(manifest.Parent) == 0 {
+			return nil, fmt.Errorf("incremental backup '%s' has no parent in its manifest", filepath.Base(item.Name))
+		}
+		parent, ok := byName[manifest.Parent]
+		if !ok {
+			return nil, fmt.Errorf("backup '%s' depends on '%s', which is missing", filepath.Base(item.Name), manifest.Parent)
+		}
+		chain = append(chain, parent)
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain, nil
+}
+
+// getIncrementalBackupsToRemove keeps the last 'keep_only' full backups with every
+// incremental backup depending on them
+func getIncrementalBackupsToRemove(t *BackupTarget, backups []BackupItem) []BackupItem {
+	var fullCount int
+	for i := len(backups) - 1; i >= 0; i-- {
+		if isIncrementalArchive(backups[i].Name) {
+			continue
+		}
+		fullCount++
+		if fullCount == t.Config.KeepOnly {
+			return backups[:i]
+		}
+	}
+	return nil
+}
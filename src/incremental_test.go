@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetRestoreChain(t *testing.T) {
+	names := []string{
+		"docs_01012024_000000.tar.gz",
+		"docs_02012024_000000.incr.tar.gz",
+		// The manifest of this run was not saved, the next one has the same parent
+		"docs_03012024_000000.incr.tar.gz",
+		"docs_04012024_000000.incr.tar.gz",
+		"docs_05012024_000000.tar.gz",
+		"docs_06012024_000000.incr.tar.gz",
+	}
+	parents := map[string]string{
+		names[1]: names[0],
+		names[2]: names[1],
+		names[3]: names[1],
+		names[5]: names[4],
+	}
+	var backupItems []BackupItem
+	for i, name := range names {
+		backupItems = append(backupItems, BackupItem{Name: "backups/" + name, Date: time.Date(2024, 1, i+1, 0, 0, 0, 0, time.UTC)})
+	}
+	var read []string
+	readManifest := func(item BackupItem) (*BackupManifest, error) {
+		name := item.Name[strings.LastIndex(item.Name, "/")+1:]
+		read = append(read, name)
+		return &BackupManifest{Archive: name, Parent: parents[name]}, nil
+	}
+
+	tests := []struct {
+		index int
+		chain []int
+	}{
+		{0, []int{0}},
+		{2, []int{0, 1, 2}},
+		{3, []int{0, 1, 3}},
+		{5, []int{4, 5}},
+	}
+	for _, test := range tests {
+		read = nil
+		chain, err := getRestoreChain(backupItems, test.index, readManifest)
+		if err != nil {
+			t.Errorf("getRestoreChain(%d): %s", test.index, err)
+			continue
+		}
+		var got, want []string
+		for _, item := range chain {
+			got = append(got, item.Name)
+		}
+		for _, i := range test.chain {
+			want = append(want, backupItems[i].Name)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("getRestoreChain(%d) = %v, want %v", test.index, got, want)
+		}
+		// Full backups are recognized by their name, without reading them
+		for _, name := range read {
+			if !isIncrementalArchive(name) {
+				t.Errorf("getRestoreChain(%d) read the manifest of full backup %s", test.index, name)
+			}
+		}
+	}
+}
+
+func TestGetRestoreChainMissingParent(t *testing.T) {
+	backupItems := []BackupItem{
+		{Name: "docs_02012024_000000.incr.tar.gz"},
+		{Name: "docs_03012024_000000.incr.tar.gz"},
+	}
+	manifests := map[string]*BackupManifest{
+		backupItems[0].Name: {Parent: "docs_01012024_000000.tar.gz"},
+		backupItems[1].Name: {Parent: backupItems[0].Name},
+	}
+	readManifest := func(item BackupItem) (*BackupManifest, error) {
+		return manifests[item.Name], nil
+	}
+	if chain, err := getRestoreChain(backupItems, 1, readManifest); err == nil {
+		t.Errorf("got %v, want an error for the missing full backup", chain)
+	}
+	// An incremental backup without manifest cannot be placed in a chain
+	manifests[backupItems[1].Name] = nil
+	if chain, err := getRestoreChain(backupItems, 1, readManifest); err == nil {
+		t.Errorf("got %v, want an error for the missing manifest", chain)
+	}
+	// Nor one whose parents loop
+	manifests[backupItems[0].Name] = &BackupManifest{Parent: backupItems[1].Name}
+	manifests[backupItems[1].Name] = &BackupManifest{Parent: backupItems[0].Name}
+	if chain, err := getRestoreChain(backupItems, 1, readManifest); err == nil {
+		t.Errorf("got %v, want an error for the cycle", chain)
+	}
+}
@@ -1,127 +1,355 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 	"time"
 )
 
-func createBackupTargetTempWorkdir(target *BackupTarget) {
+const (
+	// destinationProbeTimeout bounds the connectivity check of a destination at startup
+	destinationProbeTimeout = 30 * time.Second
+	destinationProbeKey     = ".autobackup-probe"
+)
+
+// tmpWorkdirs tracks the temporary working directories of the runs in progress,
+// so they can be removed on shutdown even if a run did not return in time
+var tmpWorkdirs = struct {
+	sync.Mutex
+	dirs map[string]string
+}{dirs: map[string]string{}}
+
+func createBackupTargetTempWorkdir(target *BackupTarget) error {
+	if len(target.TmpWorkdir) > 0 {
+		return nil
+	}
 	dir, err := ioutil.TempDir(os.TempDir(), "autobackup_"+target.Name+"_")
-	handleFatalErr(err, "Cannot create temporary working directory")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary working directory: %w", err)
+	}
 	log.Debugf("[%s] Created temporary working directory %s\n", target.Name, dir)
 	target.TmpWorkdir = dir
+	tmpWorkdirs.Lock()
+	tmpWorkdirs.dirs[dir] = target.Name
+	tmpWorkdirs.Unlock()
+	return nil
 }
 
 func deleteBackupTargetTempWorkdir(t *BackupTarget) {
+	if len(t.TmpWorkdir) == 0 {
+		return
+	}
+	tmpWorkdirs.Lock()
+	delete(tmpWorkdirs.dirs, t.TmpWorkdir)
+	tmpWorkdirs.Unlock()
 	err := os.RemoveAll(t.TmpWorkdir)
-	if err != nil {
-		handleFatalErr(err, "[%s] Error when deleting temporary working directory", t.Name)
-	} else {
+	if !handleErr(err, "[%s] Error when deleting temporary working directory", t.Name) {
 		log.Debugf("[%s] Deleted temporary working directory\n", t.Name)
 	}
 }
 
-func processBackupTarget(t *BackupTarget) {
-	createBackupTargetTempWorkdir(t)
+// keepBackupTargetTempWorkdir leaves the temporary working directory of a run in
+// place, when removing it could delete files through a snapshot still mounted
+func keepBackupTargetTempWorkdir(t *BackupTarget) {
+	if len(t.TmpWorkdir) == 0 {
+		return
+	}
+	tmpWorkdirs.Lock()
+	delete(tmpWorkdirs.dirs, t.TmpWorkdir)
+	tmpWorkdirs.Unlock()
+	log.Warnf("[%s] Keeping temporary working directory %s, remove it once the snapshot is unmounted\n", t.Name, t.TmpWorkdir)
+	t.TmpWorkdir = ""
+}
+
+func deleteAllTempWorkdirs() {
+	tmpWorkdirs.Lock()
+	defer tmpWorkdirs.Unlock()
+	for dir, name := range tmpWorkdirs.dirs {
+		if !handleErr(os.RemoveAll(dir), "[%s] Error when deleting temporary working directory", name) {
+			log.Debugf("[%s] Deleted leftover temporary working directory %s\n", name, dir)
+		}
+		delete(tmpWorkdirs.dirs, dir)
+	}
+}
+
+func processBackupTarget(ctx context.Context, t *BackupTarget) *BackupRunResult {
+	result := &BackupRunResult{Target: t.Name, Started: time.Now()}
+	defer func() { result.Duration = time.Since(result.Started) }()
+
+	// The archive is kept until the post hooks ran, so they can use it
+	t.Archive, t.TmpWorkdir = "", ""
 	defer deleteBackupTargetTempWorkdir(t)
-	t.Files = listBackupTargetFiles(t)
-	buildArchive(t)
+	if result.Err = runHooks(ctx, t, preHookStage, t.Config.PreHooks, result); result.Err == nil {
+		runBackupPipeline(ctx, t, result)
+	}
+	if result.failed() {
+		runHooks(ctx, t, onFailureHookStage, t.Config.OnFailureHooks, result)
+	} else {
+		runHooks(ctx, t, postHookStage, t.Config.PostHooks, result)
+	}
+	return result
+}
+
+func runBackupPipeline(ctx context.Context, t *BackupTarget, result *BackupRunResult) {
+	// Destinations which failed to initialize, at startup or at a previous run,
+	// are tried again and fail the run if they still cannot be used
+	initBackupTargetDestinations(t, true)
 	for _, d := range t.DestinationConfig {
-		d.runBackup()
-		if t.Config.KeepOnly > 0 {
-			d.cleanOldBackups()
+		if !d.isReady() {
+			result.Destinations = append(result.Destinations, DestinationRunResult{
+				Destination: d.getName(),
+				Err:         fmt.Errorf("destination failed to initialize"),
+			})
+		}
+	}
+	if len(getReadyDestinations(t)) == 0 {
+		result.Err = fmt.Errorf("no destination to store the backup to")
+		return
+	}
+	switch {
+	case isDatabaseTargetType(t.Config.Type):
+		result.Err = dumpDatabaseTarget(ctx, t)
+	case t.Config.Type == commandTargetType:
+		result.Err = runCommandTarget(ctx, t)
+	}
+	if result.Err != nil {
+		return
+	}
+	if t.Config.Snapshot.enabled() {
+		snapshot, err := createVolumeSnapshot(ctx, t, result.Started)
+		defer snapshot.remove()
+		if err != nil {
+			result.Err = fmt.Errorf("cannot create snapshot: %w", err)
+			return
+		}
+		sources := t.Sources
+		if t.Sources, result.Err = snapshot.getSources(sources); result.Err != nil {
+			t.Sources = sources
+			return
+		}
+		defer func() { t.Sources = sources }()
+	}
+	if t.Files, result.Err = listBackupTargetFiles(t); result.Err != nil {
+		return
+	}
+	if t.Config.Type == repositoryTargetType {
+		result.Err = backupRepositoryTarget(ctx, t, result)
+		return
+	}
+	t.Manifest = nil
+	if t.Config.Incremental {
+		t.Files, t.Manifest = planIncrementalBackup(t, t.Files, result.Started)
+		defer func() {
+			if !result.failed() {
+				handleErr(saveLastManifest(t, t.Manifest), "[%s] Cannot save backup manifest", t.Name)
+			}
+		}()
+	}
+	if t.Config.Streaming {
+		result.Err = streamBackupTarget(ctx, t, result)
+		return
+	}
+
+	if result.Err = createBackupTargetTempWorkdir(t); result.Err != nil {
+		return
+	}
+	if result.Err = buildArchive(ctx, t, result); result.Err != nil {
+		return
+	}
+	result.Archive = filepath.Base(t.Archive)
+	if info, err := os.Stat(t.Archive); err == nil {
+		result.Bytes = info.Size()
+	}
+	for _, d := range getReadyDestinations(t) {
+		if result.Err = ctx.Err(); result.Err != nil {
+			return
 		}
+		result.Destinations = append(result.Destinations, storeArchiveFile(ctx, t, d))
+	}
+}
+
+func storeArchiveFile(ctx context.Context, t *BackupTarget, d BackupDestination) (destResult DestinationRunResult) {
+	destResult.Destination = d.getName()
+	started := time.Now()
+	defer func() { destResult.Duration = time.Since(started) }()
+
+	archiveHandle, err := os.Open(t.Archive)
+	if err != nil {
+		destResult.Err = err
+		return destResult
+	}
+	defer archiveHandle.Close()
+	info, err := archiveHandle.Stat()
+	if err != nil {
+		destResult.Err = err
+		return destResult
+	}
+	destResult.Err = d.runBackup(ctx, filepath.Base(t.Archive), archiveHandle, info.Size())
+	if destResult.Err == nil && t.Config.KeepOnly > 0 {
+		destResult.CleanErr = d.cleanOldBackups(ctx)
 	}
+	return destResult
 }
 
-func launchBackupTargetCron(c *cron.Cron, t *BackupTarget) cron.EntryID {
-	entryId, err := c.AddFunc(t.Config.Cron, func() {
-		processBackupTarget(t)
+func launchBackupTargetCron(c *cron.Cron, t *BackupTarget, job func(*BackupTarget)) (cron.EntryID, error) {
+	spec, err := getBackupTargetSchedule(t)
+	if err != nil {
+		return 0, err
+	}
+	entryId, err := c.AddFunc(spec, func() {
+		job(t)
 	})
-	//processBackupTarget(t)
-	handleFatalErr(err, "Cannot create cron job : %s\n", err)
-	log.Infof("[%s] Backup target successfully configured", t.Name)
-	return entryId
+	if err != nil {
+		return 0, fmt.Errorf("cannot create cron job: %w", err)
+	}
+	// The spec was checked by getBackupTargetSchedule, so that it parses here
+	schedule, _ := cron.ParseStandard(spec)
+	nextTime := schedule.Next(time.Now())
+	log.Infof("[%s] Backup target scheduled with '%s', next run in %s (%s)\n", t.Name, spec, time.Until(nextTime).Round(time.Second), nextTime.Format("15:04 02/01/2006"))
+	return entryId, nil
+}
+
+func listBackupTargetFiles(target *BackupTarget) ([]string, error) {
+	var files []string
+	target.GitRepositories = nil
+	for _, source := range target.Sources {
+		sourceFiles, err := listBackupSourceFiles(target, source)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sourceFiles...)
+	}
+	return files, nil
 }
 
-func listBackupTargetFiles(target *BackupTarget) []string {
+func listBackupSourceFiles(target *BackupTarget, source *BackupSource) ([]string, error) {
 	var files []string
 
-	err := filepath.Walk(target.Config.Path,
+	selector, err := newFileSelector(target, source)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.Walk(source.Path,
 		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if path == source.Path {
+					return err
+				}
+				// A single unreadable or vanished entry must not fail the whole backup
+				log.Warnf("[%s] Skipping '%s': %s\n", target.Name, path, err.Error())
+				return nil
+			}
+			relPath, err := filepath.Rel(source.Path, path)
 			if err != nil {
 				return err
 			}
-			if info.IsDir() ||
-				info.Name() == ".git" ||
-				strings.Contains(path, ".git/") {
+			relPath = filepath.ToSlash(relPath)
+			if info.IsDir() {
+				// Excluded directories are not walked at all
+				if relPath != "." && selector.isExcluded(relPath, true) {
+					return filepath.SkipDir
+				}
+				// Git directories are bundled instead of walked with 'git_bundle'
+				if target.Config.GitBundle && (info.Name() == ".git" || isBareGitRepository(path)) {
+					target.GitRepositories = append(target.GitRepositories, path)
+					return filepath.SkipDir
+				}
+				if relPath == "." {
+					selector.loadIgnoreFiles(target, path, "")
+					return nil
+				}
+				if target.Config.ExcludeVcs && isVcsMarker(info.Name()) {
+					return filepath.SkipDir
+				}
+				selector.loadIgnoreFiles(target, path, relPath)
+				// Directories are archived too, to keep the empty ones and their metadata
+				if selector.isIncluded(relPath) {
+					files = append(files, path)
+				}
+				return nil
+			}
+			if relPath != "." && (selector.isExcluded(relPath, false) || !selector.isIncluded(relPath)) {
 				return nil
 			}
-			if len(target.Config.ExcludeDirs) > 0 {
-				for _, excludedDir := range target.Config.ExcludeDirs {
-					if len(excludedDir) == 0 {
-						continue
-					}
-					if excludedDir[len(excludedDir)-1] != '/' {
-						excludedDir += "/"
-					}
-					if strings.Contains(path, excludedDir) {
-						return nil
-					}
-				}
+			// A '.git' file links a worktree or a submodule to its git directory
+			if target.Config.ExcludeVcs && isVcsMarker(info.Name()) {
+				return nil
 			}
 			files = append(files, path)
 			return nil
 		})
-	handleFatalErr(err, "Cannot iterate through files at %s", target.Config.Path)
-	return files
+	if err != nil {
+		return nil, fmt.Errorf("cannot iterate through files at %s: %w", source.Path, err)
+	}
+	return files, nil
 }
 
-func main() {
-
-	log.SetLevel(log.DebugLevel)
-	log.SetReportCaller(true)
-
-	viper.SetConfigName("config")
-	viper.SetConfigType("toml")
-	viper.AddConfigPath("$HOME/.config/autobackup")
-	viper.AddConfigPath(".")
-
-	backupTargets := parseConfig()
+// initBackupTargetDestinations initializes the destinations of a target which
+// are not ready yet, checking that they accept writes unless only backups are
+// read. Destinations failing it stay configured, so that the next run tries
+// again, and their number is returned.
+func initBackupTargetDestinations(backupTarget *BackupTarget, checkWrite bool) int {
+	var failed int
+	for _, d := range backupTarget.DestinationConfig {
+		if d.isReady() {
+			continue
+		}
+		if !d.init(checkWrite) {
+			log.Warnf("%s Destination unavailable because initialization failed\n", getDestLogPrefix(d))
+			failed++
+		}
+	}
+	return failed
+}
 
-	cronRunner := cron.New()
+// getReadyDestinations returns the destinations of a target whose initialization succeeded
+func getReadyDestinations(backupTarget *BackupTarget) []BackupDestination {
+	var destinations []BackupDestination
+	for _, d := range backupTarget.DestinationConfig {
+		if d.isReady() {
+			destinations = append(destinations, d)
+		}
+	}
+	return destinations
+}
 
-	for _, backupTarget := range backupTargets {
-		log.Infof("Processing backup target '%s'\n", backupTarget.Name)
+// closeBackupTargetDestinations releases the destinations of a target once it
+// is not used anymore
+func closeBackupTargetDestinations(backupTarget *BackupTarget) {
+	for _, d := range backupTarget.DestinationConfig {
+		handleWarnErr(d.close(), "%s Cannot close destination", getDestLogPrefix(d))
+	}
+}
 
-		backupTarget.Ext = getArchiveExt(backupTarget)
+// probeDestinationWrite checks that a destination accepts writes by storing
+// then removing a small object in its folder
+func probeDestinationWrite(ctx context.Context, d BackupDestination) error {
+	content := []byte("autobackup\n")
+	if err := d.putObject(ctx, destinationProbeKey, bytes.NewReader(content), int64(len(content))); err != nil {
+		return fmt.Errorf("cannot write to destination: %w", err)
+	}
+	if err := d.deleteObject(ctx, destinationProbeKey); err != nil {
+		return fmt.Errorf("cannot delete from destination: %w", err)
+	}
+	return nil
+}
 
-		//nextTime := cronexpr.MustParse(backupTarget.Config.Cron).Next(time.Now())
-		//log.Infof("[%s] Next tick of %s in %dh%d (%s)", backupTarget.Name, backupTarget.Config.Cron, int(nextTime.Sub(time.Now()).Hours()), int(nextTime.Sub(time.Now()).Minutes())%60, nextTime.Format("15:04 02/01/2006"))
+// prepareBackupTarget sets what a target needs before its destinations are
+// initialized, which is left to the callers
+func prepareBackupTarget(backupTarget *BackupTarget) {
+	backupTarget.Ext = getArchiveExt(backupTarget)
+}
 
-		var validIndex int
-		for _, d := range backupTarget.DestinationConfig {
-			if d.init() {
-				backupTarget.DestinationConfig[validIndex] = d
-				validIndex++
-			} else {
-				log.Warnf("%s Destination removed because initialization failed\n", getDestLogPrefix(d))
-			}
-		}
-		for invalidIndex := validIndex; invalidIndex < len(backupTarget.DestinationConfig); invalidIndex++ {
-			backupTarget.DestinationConfig[invalidIndex] = nil
-		}
-		backupTarget.DestinationConfig = backupTarget.DestinationConfig[:validIndex]
-		launchBackupTargetCron(cronRunner, backupTarget)
+func main() {
+	if err := newRootCommand().Execute(); err != nil {
+		log.Errorln(err)
+		os.Exit(1)
 	}
-
-	cronRunner.Start()
-	log.Infoln("Ready")
-	time.Sleep(time.Duration(1<<63 - 1))
 }
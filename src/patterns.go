@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	ignoreFileName    = ".autobackupignore"
+	gitignoreFileName = ".gitignore"
+)
+
+// ignoreRule is a gitignore-style pattern, matched against slash separated paths
+// relative to the target path
+type ignoreRule struct {
+	// base is the directory of the ignore file the rule comes from, relative to
+	// the target path. Rules only apply below it.
+	base    string
+	pattern *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// globToRegexp translates a glob where '*' and '?' do not match '/' while '**'
+// matches any number of directories
+func globToRegexp(glob string) string {
+	var reg strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '\\' && i+1 < len(glob):
+			i++
+			reg.WriteString(regexp.QuoteMeta(string(glob[i])))
+		case strings.HasPrefix(glob[i:], "**/"):
+			reg.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			reg.WriteString(".*")
+			i++
+		case c == '*':
+			reg.WriteString("[^/]*")
+		case c == '?':
+			reg.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				reg.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			reg.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			reg.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return reg.String()
+}
+
+// parseIgnoreRule parses a line of an ignore file or a configured pattern. It
+// returns nil for blank lines and comments.
+func parseIgnoreRule(base string, line string) (*ignoreRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	rule := &ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A pattern with a separator is relative to its base, otherwise it matches at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if len(line) == 0 {
+		return nil, nil
+	}
+	reg := "^" + globToRegexp(line) + "$"
+	if !anchored {
+		reg = "^(.*/)?" + globToRegexp(line) + "$"
+	}
+	var err error
+	if rule.pattern, err = regexp.Compile(reg); err != nil {
+		return nil, fmt.Errorf("invalid pattern '%s': %w", line, err)
+	}
+	return rule, nil
+}
+
+func (r *ignoreRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if len(r.base) > 0 {
+		if !strings.HasPrefix(relPath, r.base+"/") {
+			return false
+		}
+		relPath = relPath[len(r.base)+1:]
+	}
+	return r.pattern.MatchString(relPath)
+}
+
+func parseIgnoreRules(base string, patterns []string) ([]*ignoreRule, error) {
+	var rules []*ignoreRule
+	for _, pattern := range patterns {
+		rule, err := parseIgnoreRule(base, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if rule != nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// getExcludeDirsPatterns converts the legacy 'exclude_dirs' setting into
+// patterns excluding the directories with that name at any depth
+func getExcludeDirsPatterns(t *BackupTarget, source *BackupSource) []string {
+	var patterns []string
+	for _, dir := range t.Config.ExcludeDirs {
+		if filepath.IsAbs(dir) {
+			rel, err := filepath.Rel(source.originalPath(), dir)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			patterns = append(patterns, "/"+filepath.ToSlash(rel)+"/")
+			continue
+		}
+		if dir = strings.Trim(dir, "/"); len(dir) > 0 {
+			patterns = append(patterns, "**/"+dir+"/")
+		}
+	}
+	return patterns
+}
+
+// fileSelector decides which files of a target path are backed up, from the
+// 'include' and 'exclude' patterns and the ignore files found in the tree
+type fileSelector struct {
+	include     []*ignoreRule
+	exclude     []*ignoreRule
+	ignoreFiles []string
+	// dirRules are the rules of the ignore files, by directory relative to the target path
+	dirRules map[string][]*ignoreRule
+}
+
+func newFileSelector(t *BackupTarget, source *BackupSource) (*fileSelector, error) {
+	include, err := parseIgnoreRules("", source.Include)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'include': %w", err)
+	}
+	exclude, err := parseIgnoreRules("", append(getExcludeDirsPatterns(t, source), source.Exclude...))
+	if err != nil {
+		return nil, fmt.Errorf("invalid 'exclude': %w", err)
+	}
+	selector := &fileSelector{
+		include:     include,
+		exclude:     exclude,
+		ignoreFiles: []string{ignoreFileName},
+		dirRules:    map[string][]*ignoreRule{},
+	}
+	if t.Config.UseGitignore {
+		selector.ignoreFiles = []string{gitignoreFileName, ignoreFileName}
+	}
+	return selector, nil
+}
+
+// loadIgnoreFiles reads the ignore files of a directory about to be walked.
+// Unreadable ignore files and invalid patterns are skipped with a warning.
+func (s *fileSelector) loadIgnoreFiles(t *BackupTarget, dir string, relDir string) {
+	for _, name := range s.ignoreFiles {
+		file, err := os.Open(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if handleWarnErr(err, "[%s] Cannot read ignore file", t.Name) {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			rule, err := parseIgnoreRule(relDir, scanner.Text())
+			if handleWarnErr(err, "[%s] Skipping line of %s", t.Name, filepath.Join(dir, name)) {
+				continue
+			}
+			if rule != nil {
+				s.dirRules[relDir] = append(s.dirRules[relDir], rule)
+			}
+		}
+		handleWarnErr(scanner.Err(), "[%s] Cannot read ignore file", t.Name)
+		file.Close()
+		log.Debugf("[%s] Loaded ignore file %s\n", t.Name, filepath.Join(dir, name))
+	}
+}
+
+// isExcluded applies the rules of the ignore files from the target path down to
+// the entry, then the 'exclude' patterns. The last matching rule wins, so a
+// negated pattern re-includes what an earlier one excluded.
+func (s *fileSelector) isExcluded(relPath string, isDir bool) bool {
+	var excluded bool
+	apply := func(rules []*ignoreRule) {
+		for _, rule := range rules {
+			if rule.match(relPath, isDir) {
+				excluded = !rule.negate
+			}
+		}
+	}
+	apply(s.dirRules[""])
+	for i := range relPath {
+		if relPath[i] == '/' {
+			apply(s.dirRules[relPath[:i]])
+		}
+	}
+	apply(s.exclude)
+	return excluded
+}
+
+// isIncluded reports whether a file matches the 'include' patterns, either
+// itself or through one of its parent directories
+func (s *fileSelector) isIncluded(relPath string) bool {
+	if len(s.include) == 0 {
+		return true
+	}
+	var included bool
+	for _, rule := range s.include {
+		for p, isDir := relPath, false; p != "." && p != "/"; p, isDir = path.Dir(p), true {
+			if rule.match(p, isDir) {
+				included = !rule.negate
+				break
+			}
+		}
+	}
+	return included
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		matches []string
+		rejects []string
+	}{
+		{"*.log", []string{"a.log", ".log"}, []string{"dir/a.log", "a.logs"}},
+		{"?.txt", []string{"a.txt"}, []string{"ab.txt", "/.txt"}},
+		{"**/cache", []string{"cache", "a/cache", "a/b/cache"}, []string{"acache", "cache/a"}},
+		{"build/**", []string{"build/a", "build/a/b"}, []string{"build", "a/build/b"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"a/xb", "b"}},
+		{"[abc].go", []string{"a.go", "c.go"}, []string{"d.go", "ab.go"}},
+		{"[!abc].go", []string{"d.go"}, []string{"a.go"}},
+		{"[unclosed", []string{"[unclosed"}, []string{"u"}},
+		{`\*.txt`, []string{"*.txt"}, []string{"a.txt"}},
+		{"a+b(c).txt", []string{"a+b(c).txt"}, []string{"aab(c).txt"}},
+	}
+	for _, test := range tests {
+		reg := regexp.MustCompile("^" + globToRegexp(test.glob) + "$")
+		for _, name := range test.matches {
+			if !reg.MatchString(name) {
+				t.Errorf("glob %q should match %q", test.glob, name)
+			}
+		}
+		for _, name := range test.rejects {
+			if reg.MatchString(name) {
+				t.Errorf("glob %q should not match %q", test.glob, name)
+			}
+		}
+	}
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	tests := []struct {
+		base    string
+		line    string
+		relPath string
+		isDir   bool
+		match   bool
+	}{
+		// Patterns without a separator match at any depth
+		{"", "*.tmp", "a.tmp", false, true},
+		{"", "*.tmp", "a/b/c.tmp", false, true},
+		// Patterns with a separator, a leading one included, are anchored
+		{"", "/build", "build", true, true},
+		{"", "/build", "src/build", true, false},
+		{"", "doc/*.md", "doc/a.md", false, true},
+		{"", "doc/*.md", "x/doc/a.md", false, false},
+		// A trailing slash only matches directories
+		{"", "logs/", "logs", true, true},
+		{"", "logs/", "logs", false, false},
+		{"", "logs/", "a/logs", true, true},
+		// Rules of an ignore file only apply below its directory
+		{"sub", "*.o", "sub/a.o", false, true},
+		{"sub", "*.o", "a.o", false, false},
+		{"sub", "*.o", "subdir/a.o", false, false},
+		{"sub", "/gen", "sub/gen", true, true},
+		{"sub", "/gen", "sub/x/gen", true, false},
+	}
+	for _, test := range tests {
+		rule, err := parseIgnoreRule(test.base, test.line)
+		if err != nil {
+			t.Fatalf("parseIgnoreRule(%q, %q): %s", test.base, test.line, err)
+		}
+		if match := rule.match(test.relPath, test.isDir); match != test.match {
+			t.Errorf("rule %q of %q on %q (dir %v): got %v, want %v", test.line, test.base, test.relPath, test.isDir, match, test.match)
+		}
+	}
+}
+
+func TestParseIgnoreRuleSkipsBlankLines(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/", "!"} {
+		rule, err := parseIgnoreRule("", line)
+		if err != nil || rule != nil {
+			t.Errorf("parseIgnoreRule(%q) = %v, %v, want no rule", line, rule, err)
+		}
+	}
+	rule, err := parseIgnoreRule("", "!keep.log")
+	if err != nil || rule == nil || !rule.negate {
+		t.Errorf("parseIgnoreRule(\"!keep.log\") should return a negated rule")
+	}
+}
+
+func TestFileSelectorIsExcluded(t *testing.T) {
+	target := &BackupTarget{Config: BackupTargetConfig{ExcludeDirs: []string{"node_modules"}}}
+	source := &BackupSource{Path: "/data", Exclude: []string{"*.log", "!important.log", "/tmp/"}}
+	selector, err := newFileSelector(target, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rules of an ignore file in 'sub', which the 'exclude' patterns come after
+	selector.dirRules["sub"], err = parseIgnoreRules("sub", []string{"*.bin", "!keep.bin", "secret.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		relPath  string
+		isDir    bool
+		excluded bool
+	}{
+		{"a.txt", false, false},
+		{"a.log", false, true},
+		{"dir/a.log", false, true},
+		{"important.log", false, false},
+		{"dir/important.log", false, false},
+		{"tmp", true, true},
+		{"tmp", false, false},
+		{"dir/tmp", true, false},
+		{"node_modules", true, true},
+		{"a/b/node_modules", true, true},
+		{"sub/a.bin", false, true},
+		{"sub/keep.bin", false, false},
+		{"a.bin", false, false},
+		// The last matching rule wins, and the 'exclude' patterns are applied last
+		{"sub/important.log", false, false},
+		{"sub/secret.log", false, true},
+	}
+	for _, test := range tests {
+		if excluded := selector.isExcluded(test.relPath, test.isDir); excluded != test.excluded {
+			t.Errorf("isExcluded(%q, dir %v) = %v, want %v", test.relPath, test.isDir, excluded, test.excluded)
+		}
+	}
+}
+
+func TestFileSelectorIsIncluded(t *testing.T) {
+	source := &BackupSource{Path: "/data", Include: []string{"src/", "*.md"}}
+	selector, err := newFileSelector(&BackupTarget{}, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"src/main.go":     true,
+		"src/pkg/util.go": true,
+		"README.md":       true,
+		"doc/guide.md":    true,
+		"main.go":         false,
+		"other/src.go":    false,
+	}
+	for relPath, included := range tests {
+		if got := selector.isIncluded(relPath); got != included {
+			t.Errorf("isIncluded(%q) = %v, want %v", relPath, got, included)
+		}
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	repositorySnapshotExt = ".snapshot"
+	minChunkSize          = 256 << 10
+	maxChunkSize          = 8 << 20
+	// chunkBoundaryMask gives an average chunk size of 1MiB. The highest bits of
+	// the gear hash are used, since they depend on the most bytes.
+	chunkBoundaryMask = uint64(1<<20-1) << 44
+)
+
+type RepositoryConfig struct {
+	// Prefix is the folder of the repository in every destination, the target name by default
+	Prefix string `mapstructure:"prefix"`
+}
+
+// SnapshotFile describes a file of a snapshot with the fields of its archive header
+type SnapshotFile struct {
+	Name    string            `json:"name"`
+	Type    byte              `json:"type"`
+	Link    string            `json:"link,omitempty"`
+	Mode    int64             `json:"mode"`
+	Uid     int               `json:"uid"`
+	Gid     int               `json:"gid"`
+	Uname   string            `json:"uname,omitempty"`
+	Gname   string            `json:"gname,omitempty"`
+	ModTime time.Time         `json:"mtime"`
+	Size    int64             `json:"size"`
+	Xattrs  map[string]string `json:"xattrs,omitempty"`
+	Chunks  []string          `json:"chunks,omitempty"`
+}
+
+func newSnapshotFile(header *tar.Header) *SnapshotFile {
+	file := &SnapshotFile{
+		Name:    header.Name,
+		Type:    header.Typeflag,
+		Link:    header.Linkname,
+		Mode:    header.Mode,
+		Uid:     header.Uid,
+		Gid:     header.Gid,
+		Uname:   header.Uname,
+		Gname:   header.Gname,
+		ModTime: header.ModTime,
+		Size:    header.Size,
+	}
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, xattrPaxPrefix) {
+			if file.Xattrs == nil {
+				file.Xattrs = map[string]string{}
+			}
+			file.Xattrs[strings.TrimPrefix(key, xattrPaxPrefix)] = value
+		}
+	}
+	return file
+}
+
+func (f *SnapshotFile) header() *tar.Header {
+	header := &tar.Header{
+		Name:     f.Name,
+		Typeflag: f.Type,
+		Linkname: f.Link,
+		Mode:     f.Mode,
+		Uid:      f.Uid,
+		Gid:      f.Gid,
+		Uname:    f.Uname,
+		Gname:    f.Gname,
+		ModTime:  f.ModTime,
+		Size:     f.Size,
+	}
+	for name, value := range f.Xattrs {
+		if header.PAXRecords == nil {
+			header.PAXRecords = map[string]string{}
+		}
+		header.PAXRecords[xattrPaxPrefix+name] = value
+	}
+	return header
+}
+
+// RepositorySnapshot is the index of a backup of a repository target, listing
+// the chunks every file is made of
+type RepositorySnapshot struct {
+	Target  string          `json:"target"`
+	Created time.Time       `json:"created"`
+	Files   []*SnapshotFile `json:"files"`
+}
+
+var gearTable = newGearTable()
+
+// newGearTable returns the random values of the chunking rolling hash. They are
+// derived from a fixed seed since changing them would change every chunk boundary.
+func newGearTable() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x61757465626b7570)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// chunker splits a stream into content-defined chunks, so that an insertion in
+// a file only changes the chunks around it
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: bufio.NewReaderSize(r, 1<<20), buf: make([]byte, 0, maxChunkSize)}
+}
+
+// next returns the next chunk, only valid until the following call, or io.EOF
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+	for {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			return c.buf, nil
+		} else if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = (hash << 1) + gearTable[b]
+		if (len(c.buf) >= minChunkSize && hash&chunkBoundaryMask == 0) || len(c.buf) >= maxChunkSize {
+			return c.buf, nil
+		}
+	}
+}
+
+func getRepositoryPrefix(t *BackupTarget) string {
+	if len(t.Config.Repository.Prefix) > 0 {
+		return strings.Trim(t.Config.Repository.Prefix, "/")
+	}
+	return t.Name
+}
+
+// getDestinationLocation returns where a destination stores its objects, as a
+// slash separated path that is the same for destinations sharing a storage
+func getDestinationLocation(d BackupDestination) string {
+	switch d := d.(type) {
+	case *BackupDestinationLocal:
+		dir, err := filepath.Abs(d.Directory)
+		if err != nil {
+			dir = d.Directory
+		}
+		return path.Join("local", filepath.ToSlash(dir))
+	case *BackupDestinationAws:
+		return path.Join("aws", d.Endpoint, d.Bucket, d.Folder)
+	case *BackupDestinationGcp:
+		return path.Join("gcp", d.Bucket, d.Folder)
+	case *BackupDestinationSftp:
+		return path.Join("sftp", fmt.Sprintf("%s:%d", d.Host, d.Port), d.Directory)
+	}
+	return d.getName()
+}
+
+// validateRepositoryPrefixes rejects repository targets storing their objects
+// under the same prefix of a destination, or one within the other, since the
+// garbage collection of each would remove the chunks of the others
+func validateRepositoryPrefixes(backupTargets []*BackupTarget) error {
+	owners := make(map[string]string)
+	for _, t := range backupTargets {
+		if t.Config.Type != repositoryTargetType {
+			continue
+		}
+		for _, d := range t.DestinationConfig {
+			location := path.Join(getDestinationLocation(d), getRepositoryPrefix(t))
+			for other, name := range owners {
+				if name != t.Name && (location == other || strings.HasPrefix(location, other+"/") || strings.HasPrefix(other, location+"/")) {
+					return fmt.Errorf("[%s] the repository overlaps the one of '%s' at its %s destination, set a distinct 'repository.prefix'", t.Name, name, d.getName())
+				}
+			}
+			owners[location] = t.Name
+		}
+	}
+	return nil
+}
+
+func getChunkKey(t *BackupTarget, id string) string {
+	return path.Join(getRepositoryPrefix(t), "chunks", id[:2], id)
+}
+
+func getChunkId(key string) string {
+	return path.Base(key)
+}
+
+func getSnapshotKey(t *BackupTarget, name string) string {
+	return path.Join(getRepositoryPrefix(t), "snapshots", name)
+}
+
+var (
+	repositoryEncoder, _ = zstd.NewWriter(nil)
+	repositoryDecoder, _ = zstd.NewReader(nil)
+)
+
+// listRepositoryChunks returns the ids of the chunks already stored in a destination
+func listRepositoryChunks(ctx context.Context, t *BackupTarget, d BackupDestination) (map[string]bool, error) {
+	keys, err := d.listObjects(ctx, path.Join(getRepositoryPrefix(t), "chunks"))
+	if err != nil {
+		return nil, err
+	}
+	chunks := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		chunks[getChunkId(key)] = true
+	}
+	return chunks, nil
+}
+
+// repositoryUpload tracks a destination during the backup of a repository target
+type repositoryUpload struct {
+	d      BackupDestination
+	chunks map[string]bool
+	result *DestinationRunResult
+}
+
+// storeChunk uploads a chunk to the destinations not holding it yet. It returns
+// the number of bytes uploaded, and an error only if every destination failed.
+func storeChunk(ctx context.Context, t *BackupTarget, uploads []*repositoryUpload, chunk []byte) (string, int64, error) {
+	sum := sha256.Sum256(chunk)
+	id := hex.EncodeToString(sum[:])
+	var encoded []byte
+	var uploaded int64
+	var alive int
+	for _, upload := range uploads {
+		if upload.result.Err != nil {
+			continue
+		}
+		alive++
+		if upload.chunks[id] {
+			continue
+		}
+		if encoded == nil {
+			encoded = repositoryEncoder.EncodeAll(chunk, nil)
+		}
+		if err := upload.d.putObject(ctx, getChunkKey(t, id), bytes.NewReader(encoded), int64(len(encoded))); err != nil {
+			upload.result.Err = fmt.Errorf("cannot store chunk %s: %w", id, err)
+			handleErr(upload.result.Err, getDestLogPrefix(upload.d))
+			alive--
+			continue
+		}
+		upload.chunks[id] = true
+		uploaded += int64(len(encoded))
+	}
+	if alive == 0 {
+		return id, uploaded, fmt.Errorf("every destination failed")
+	}
+	return id, uploaded, nil
+}
+
+// addFileToRepository chunks a file and stores its new chunks. Directories and
+// symlinks only get described. It returns nil if the file cannot be read, in
+// which case it is skipped.
+func addFileToRepository(ctx context.Context, t *BackupTarget, uploads []*repositoryUpload, f string, name string, result *BackupRunResult) (*SnapshotFile, error) {
+	info, err := os.Lstat(f)
+	if err != nil {
+		log.Warnf("[%s] Skipping file: %s\n", t.Name, err.Error())
+		return nil, nil
+	}
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(f); err != nil {
+			log.Warnf("[%s] Skipping file: %s\n", t.Name, err.Error())
+			return nil, nil
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		log.Warnf("[%s] Skipping file %s: %s\n", t.Name, f, err.Error())
+		return nil, nil
+	}
+	header.Name = name
+	if t.Config.PreserveXattrs {
+		addXattrsToHeader(t, f, header)
+	}
+	file := newSnapshotFile(header)
+	if header.Typeflag != tar.TypeReg {
+		return file, nil
+	}
+
+	fileHandle, err := os.Open(f)
+	if err != nil {
+		log.Warnf("[%s] Skipping file: %s\n", t.Name, err.Error())
+		return nil, nil
+	}
+	defer fileHandle.Close()
+	if info, err = fileHandle.Stat(); err != nil {
+		log.Warnf("[%s] Skipping file: %s\n", t.Name, err.Error())
+		return nil, nil
+	}
+	chunks := newChunker(&contextReader{ctx: ctx, r: fileHandle})
+	file.Size = 0
+	for {
+		chunk, err := chunks.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read file %s: %w", f, err)
+		}
+		id, uploaded, err := storeChunk(ctx, t, uploads, chunk)
+		if err != nil {
+			return nil, err
+		}
+		file.Chunks = append(file.Chunks, id)
+		file.Size += int64(len(chunk))
+		result.Bytes += uploaded
+	}
+	if hasFileChanged(fileHandle, info) {
+		reportChangedFile(t, f, result)
+	}
+	return file, nil
+}
+
+// backupRepositoryTarget stores the files of the target as deduplicated chunks
+// in every destination, then writes the snapshot indexing them
+func backupRepositoryTarget(ctx context.Context, t *BackupTarget, result *BackupRunResult) error {
+	destinations := getReadyDestinations(t)
+	if len(destinations) == 0 {
+		return fmt.Errorf("no destination to store the snapshot to")
+	}
+	result.Archive = getArchiveName(t, result.Started)
+	// The results are appended to those of the destinations which failed to
+	// initialize, and not moved afterwards since the uploads point to them
+	first := len(result.Destinations)
+	result.Destinations = append(result.Destinations, make([]DestinationRunResult, len(destinations))...)
+	uploads := make([]*repositoryUpload, len(destinations))
+	for i, d := range destinations {
+		result.Destinations[first+i].Destination = d.getName()
+		uploads[i] = &repositoryUpload{d: d, result: &result.Destinations[first+i]}
+		uploads[i].chunks, uploads[i].result.Err = listRepositoryChunks(ctx, t, d)
+		handleErr(uploads[i].result.Err, "%s Cannot list repository chunks", getDestLogPrefix(d))
+	}
+
+	snapshot := &RepositorySnapshot{Target: t.Name, Created: result.Started}
+	for _, f := range t.Files {
+		file, err := addFileToRepository(ctx, t, uploads, f, getArchiveEntryName(t, f), result)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			result.SkippedFiles++
+			continue
+		}
+		snapshot.Files = append(snapshot.Files, file)
+		result.Files++
+	}
+	err := addGitBundles(ctx, t, result, func(bundlePath string, name string) (bool, error) {
+		file, err := addFileToRepository(ctx, t, uploads, bundlePath, name, result)
+		if file != nil {
+			snapshot.Files = append(snapshot.Files, file)
+		}
+		return file != nil, err
+	})
+	if err != nil {
+		return err
+	}
+	if err := checkChangedFiles(t, result); err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	encoded := repositoryEncoder.EncodeAll(content, nil)
+	for _, upload := range uploads {
+		if upload.result.Err != nil {
+			continue
+		}
+		if upload.result.Err = ctx.Err(); upload.result.Err != nil {
+			continue
+		}
+		upload.result.Err = upload.d.putObject(ctx, getSnapshotKey(t, result.Archive), bytes.NewReader(encoded), int64(len(encoded)))
+		if handleErr(upload.result.Err, "%s Cannot store snapshot", getDestLogPrefix(upload.d)) {
+			continue
+		}
+		log.Infoln(getDestLogPrefix(upload.d), "Snapshot saved")
+		if t.Config.KeepOnly > 0 {
+			upload.result.CleanErr = cleanRepository(ctx, t, upload.d)
+			handleErr(upload.result.CleanErr, getDestLogPrefix(upload.d))
+		}
+	}
+	for _, upload := range uploads {
+		upload.result.Duration = time.Since(result.Started)
+	}
+	return nil
+}
+
+func fetchRepositorySnapshot(ctx context.Context, d BackupDestination, item BackupItem) (*RepositorySnapshot, error) {
+	var content bytes.Buffer
+	if err := d.fetchBackup(ctx, item, &content); err != nil {
+		return nil, err
+	}
+	decoded, err := repositoryDecoder.DecodeAll(content.Bytes(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress snapshot %s: %w", item.Name, err)
+	}
+	snapshot := &RepositorySnapshot{}
+	if err := json.Unmarshal(decoded, snapshot); err != nil {
+		return nil, fmt.Errorf("cannot decode snapshot %s: %w", item.Name, err)
+	}
+	return snapshot, nil
+}
+
+// cleanRepository removes the snapshots exceeding 'keep_only', then the chunks no
+// remaining snapshot refers to
+func cleanRepository(ctx context.Context, t *BackupTarget, d BackupDestination) error {
+	if err := d.cleanOldBackups(ctx); err != nil {
+		return err
+	}
+	snapshots, err := d.buildBackupsList(ctx)
+	if err != nil {
+		return err
+	}
+	referenced := make(map[string]bool)
+	for _, item := range snapshots {
+		snapshot, err := fetchRepositorySnapshot(ctx, d, item)
+		if err != nil {
+			return err
+		}
+		for _, file := range snapshot.Files {
+			for _, id := range file.Chunks {
+				referenced[id] = true
+			}
+		}
+	}
+	chunks, err := d.listObjects(ctx, path.Join(getRepositoryPrefix(t), "chunks"))
+	if err != nil {
+		return err
+	}
+	var removed int
+	for _, key := range chunks {
+		if referenced[getChunkId(key)] {
+			continue
+		}
+		if err := d.deleteObject(ctx, key); err != nil {
+			return err
+		}
+		removed++
+	}
+	log.Infof("%s Removed %d unreferenced chunk(s)\n", getDestLogPrefix(d), removed)
+	return nil
+}
+
+// snapshotFileReader reads the content of a file by fetching its chunks in order
+type snapshotFileReader struct {
+	ctx     context.Context
+	t       *BackupTarget
+	d       BackupDestination
+	chunks  []string
+	current *bytes.Reader
+}
+
+func (r *snapshotFileReader) Read(p []byte) (int, error) {
+	for r.current == nil || r.current.Len() == 0 {
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		var content bytes.Buffer
+		if err := r.d.getObject(r.ctx, getChunkKey(r.t, r.chunks[0]), &content); err != nil {
+			return 0, fmt.Errorf("cannot fetch chunk %s: %w", r.chunks[0], err)
+		}
+		decoded, err := repositoryDecoder.DecodeAll(content.Bytes(), nil)
+		if err != nil {
+			return 0, fmt.Errorf("cannot decompress chunk %s: %w", r.chunks[0], err)
+		}
+		r.chunks = r.chunks[1:]
+		r.current = bytes.NewReader(decoded)
+	}
+	return r.current.Read(p)
+}
+
+// restoreRepositorySnapshot restores the files of a snapshot from their chunks
+func restoreRepositorySnapshot(ctx context.Context, t *BackupTarget, d BackupDestination, item BackupItem, restorer *archiveRestorer) (int, error) {
+	snapshot, err := fetchRepositorySnapshot(ctx, d, item)
+	if err != nil {
+		return 0, err
+	}
+	for _, file := range snapshot.Files {
+		content := &snapshotFileReader{ctx: ctx, t: t, d: d, chunks: file.Chunks}
+		if err := restorer.restoreEntry(file.header(), content); err != nil {
+			return restorer.count, err
+		}
+	}
+	return restorer.count, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// splitChunks returns the hashes of the chunks of data, checking that they
+// rebuild it and respect the chunk size bounds
+func splitChunks(t *testing.T, data []byte) [][32]byte {
+	var hashes [][32]byte
+	var rebuilt bytes.Buffer
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > maxChunkSize {
+			t.Fatalf("chunk of %d bytes exceeds the maximum size", len(chunk))
+		}
+		if len(chunk) < minChunkSize && rebuilt.Len()+len(chunk) != len(data) {
+			t.Fatalf("chunk of %d bytes is below the minimum size and not the last one", len(chunk))
+		}
+		rebuilt.Write(chunk)
+		hashes = append(hashes, sha256.Sum256(chunk))
+	}
+	if !bytes.Equal(rebuilt.Bytes(), data) {
+		t.Fatal("chunks do not rebuild the input")
+	}
+	return hashes
+}
+
+func countSharedChunks(a [][32]byte, b [][32]byte) int {
+	known := map[[32]byte]bool{}
+	for _, hash := range a {
+		known[hash] = true
+	}
+	var shared int
+	for _, hash := range b {
+		if known[hash] {
+			shared++
+		}
+	}
+	return shared
+}
+
+func TestChunkerBoundariesAreStable(t *testing.T) {
+	data := make([]byte, 24<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	original := splitChunks(t, data)
+	if len(original) < 8 {
+		t.Fatalf("got %d chunks for 24MiB, want an average chunk size close to 1MiB", len(original))
+	}
+	if again := splitChunks(t, data); countSharedChunks(original, again) != len(original) {
+		t.Fatal("chunking the same input twice gives different chunks")
+	}
+
+	// An insertion near the start only changes the chunks around it
+	inserted := append(append(append([]byte{}, data[:1000]...), []byte("inserted bytes")...), data[1000:]...)
+	if shared := countSharedChunks(original, splitChunks(t, inserted)); shared < len(original)-2 {
+		t.Errorf("only %d of %d chunks are unchanged after an insertion", shared, len(original))
+	}
+	// So does a removal in the middle
+	middle := len(data) / 2
+	removed := append(append([]byte{}, data[:middle]...), data[middle+4096:]...)
+	if shared := countSharedChunks(original, splitChunks(t, removed)); shared < len(original)-2 {
+		t.Errorf("only %d of %d chunks are unchanged after a removal", shared, len(original))
+	}
+}
+
+func TestChunkerMaximumSize(t *testing.T) {
+	// Constant data never hits a boundary, chunks are cut at the maximum size
+	data := make([]byte, 2*maxChunkSize+10)
+	hashes := splitChunks(t, data)
+	if len(hashes) != 3 {
+		t.Errorf("got %d chunks, want 3", len(hashes))
+	}
+}
+
+func TestChunkerEmptyInput(t *testing.T) {
+	if _, err := newChunker(bytes.NewReader(nil)).next(); err != io.EOF {
+		t.Errorf("got %v, want io.EOF", err)
+	}
+}
+
+func TestValidateRepositoryPrefixes(t *testing.T) {
+	newTarget := func(name string, prefix string, directory string) *BackupTarget {
+		return &BackupTarget{
+			Name:              name,
+			Config:            BackupTargetConfig{Type: repositoryTargetType, Repository: RepositoryConfig{Prefix: prefix}},
+			DestinationConfig: []BackupDestination{&BackupDestinationLocal{Directory: directory}},
+		}
+	}
+	tests := []struct {
+		targets []*BackupTarget
+		fails   bool
+	}{
+		{[]*BackupTarget{newTarget("a", "", "/backups"), newTarget("b", "", "/backups")}, false},
+		{[]*BackupTarget{newTarget("a", "repo", "/backups"), newTarget("b", "repo", "/other")}, false},
+		{[]*BackupTarget{newTarget("a", "repo", "/backups"), newTarget("b", "repo/", "/backups")}, true},
+		{[]*BackupTarget{newTarget("a", "", "/backups"), newTarget("b", "a/sub", "/backups")}, true},
+		{[]*BackupTarget{newTarget("a", "sub", "/backups/b"), newTarget("b", "", "/backups")}, true},
+	}
+	for i, test := range tests {
+		if err := validateRepositoryPrefixes(test.targets); (err != nil) != test.fails {
+			t.Errorf("case %d: got %v, want an error: %v", i, err, test.fails)
+		}
+	}
+	// Other target types do not collect garbage
+	other := newTarget("b", "a", "/backups")
+	other.Config.Type = filesTargetType
+	if err := validateRepositoryPrefixes([]*BackupTarget{newTarget("a", "", "/backups"), other}); err != nil {
+		t.Errorf("a files target was taken for a repository: %s", err)
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type RestoreOptions struct {
+	Destination  string
+	Backup       string
+	OutputDir    string
+	Paths        []string
+	Overwrite    bool
+	IdentityFile string
+}
+
+// selectBackupItems returns the backup to restore, the latest one by default,
+// preceded by the backups it depends on if it is incremental
+func selectBackupItems(ctx context.Context, d BackupDestination, name string, readManifest func(BackupItem) (*BackupManifest, error)) ([]BackupItem, error) {
+	backupItems, err := d.buildBackupsList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(backupItems) == 0 {
+		return nil, fmt.Errorf("%s No backup found", getDestLogPrefix(d))
+	}
+	sortBackups(backupItems)
+	index := len(backupItems) - 1
+	if len(name) > 0 {
+		for index = len(backupItems) - 1; index >= 0; index-- {
+			if backupItems[index].Name == name || filepath.Base(backupItems[index].Name) == name {
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("%s No backup named '%s'", getDestLogPrefix(d), name)
+		}
+	}
+	if !isIncrementalArchive(backupItems[index].Name) {
+		return backupItems[index : index+1], nil
+	}
+	return getRestoreChain(backupItems, index, readManifest)
+}
+
+// getRestoreOutputDir returns the directory entries are restored into, or an
+// empty string when each target path gets back the entries below its prefix
+func getRestoreOutputDir(t *BackupTarget, opts RestoreOptions) string {
+	if len(opts.OutputDir) > 0 {
+		return parseTilde(opts.OutputDir)
+	}
+	if t.Config.PreserveAbsoluteHierarchy {
+		return "/"
+	}
+	if isDatabaseTargetType(t.Config.Type) || t.Config.Type == commandTargetType {
+		// Dumps and command outputs are restored as files, to load by hand. SQLite
+		// databases are not restored over the live one, whose write-ahead log
+		// would be replayed into the restored copy.
+		return "."
+	}
+	if len(t.Sources) == 1 && len(t.Sources[0].Prefix) == 0 {
+		if info, err := os.Stat(t.Sources[0].Path); err == nil && !info.IsDir() {
+			return filepath.Dir(t.Sources[0].Path)
+		}
+		return t.Sources[0].Path
+	}
+	return ""
+}
+
+func isRestorePathSelected(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	name = strings.TrimPrefix(filepath.Clean("/"+name), "/")
+	for _, p := range paths {
+		p = strings.TrimPrefix(filepath.Clean("/"+p), "/")
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func getRestoreEntryPath(outputDir string, name string) string {
+	// Rooting the entry name before joining prevents '..' components from escaping outputDir
+	return filepath.Join(outputDir, filepath.Clean("/"+name))
+}
+
+// archiveRestorer writes archive entries below the output directory. A single
+// restorer replays every archive of an incremental chain, so that the files
+// restored from an earlier archive are overwritten by the later ones.
+type archiveRestorer struct {
+	t         *BackupTarget
+	opts      RestoreOptions
+	outputDir string
+	restored  map[string]bool
+	count     int
+	// dirs get their metadata once everything is restored, since adding entries
+	// to a directory changes its modification time. Only the directories created
+	// by the restore get it, unless 'overwrite' is set.
+	dirs        []restoredDir
+	dirIndexes  map[string]int
+	createdDirs map[string]bool
+	chown       bool
+	uids        map[string]int
+	gids        map[string]int
+}
+
+type restoredDir struct {
+	path   string
+	header *tar.Header
+}
+
+func newArchiveRestorer(t *BackupTarget, opts RestoreOptions) *archiveRestorer {
+	return &archiveRestorer{
+		t:           t,
+		opts:        opts,
+		outputDir:   getRestoreOutputDir(t, opts),
+		restored:    map[string]bool{},
+		dirIndexes:  map[string]int{},
+		createdDirs: map[string]bool{},
+		chown:       os.Geteuid() == 0,
+		uids:        map[string]int{},
+		gids:        map[string]int{},
+	}
+}
+
+// getEntryPath returns where an entry is restored and the directory it must
+// stay below, which is the output directory or the target path of its prefix
+func (r *archiveRestorer) getEntryPath(name string) (string, string, bool) {
+	if len(r.outputDir) > 0 {
+		return getRestoreEntryPath(r.outputDir, name), r.outputDir, true
+	}
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, source := range r.t.Sources {
+		if name == source.Prefix || strings.HasPrefix(name, source.Prefix+"/") {
+			return getRestoreEntryPath(source.Path, strings.TrimPrefix(name, source.Prefix)), source.Path, true
+		}
+	}
+	return "", "", false
+}
+
+func (r *archiveRestorer) describeOutput() string {
+	if len(r.outputDir) > 0 {
+		return "'" + r.outputDir + "'"
+	}
+	return "the target paths"
+}
+
+// hasSymlinkParent reports whether a directory between the root and the entry
+// is a symlink, which a crafted archive could use to write elsewhere
+func (r *archiveRestorer) hasSymlinkParent(root string, entryPath string) bool {
+	rel, err := filepath.Rel(root, filepath.Dir(entryPath))
+	if err != nil || rel == "." {
+		return false
+	}
+	parent := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		parent = filepath.Join(parent, part)
+		if info, err := os.Lstat(parent); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getOwner returns the ids of the owner of an entry, looking up its user and
+// group names first since ids differ between systems
+func (r *archiveRestorer) getOwner(header *tar.Header) (int, int) {
+	uid, gid := header.Uid, header.Gid
+	if len(header.Uname) > 0 {
+		if _, ok := r.uids[header.Uname]; !ok {
+			r.uids[header.Uname] = uid
+			if u, err := user.Lookup(header.Uname); err == nil {
+				if id, err := strconv.Atoi(u.Uid); err == nil {
+					r.uids[header.Uname] = id
+				}
+			}
+		}
+		uid = r.uids[header.Uname]
+	}
+	if len(header.Gname) > 0 {
+		if _, ok := r.gids[header.Gname]; !ok {
+			r.gids[header.Gname] = gid
+			if g, err := user.LookupGroup(header.Gname); err == nil {
+				if id, err := strconv.Atoi(g.Gid); err == nil {
+					r.gids[header.Gname] = id
+				}
+			}
+		}
+		gid = r.gids[header.Gname]
+	}
+	return uid, gid
+}
+
+// applyMetadata restores the ownership when running as root, then the mode,
+// the extended attributes and the modification time of an entry
+func (r *archiveRestorer) applyMetadata(entryPath string, header *tar.Header) {
+	hasOwner := len(header.Uname) > 0 || len(header.Gname) > 0 || header.Uid != 0 || header.Gid != 0
+	if r.chown && hasOwner {
+		uid, gid := r.getOwner(header)
+		handleWarnErr(os.Lchown(entryPath, uid, gid), "[%s] Cannot restore owner of '%s'", r.t.Name, entryPath)
+	}
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, xattrPaxPrefix) {
+			err := setXattr(entryPath, strings.TrimPrefix(key, xattrPaxPrefix), value)
+			handleWarnErr(err, "[%s] Cannot restore extended attribute of '%s'", r.t.Name, entryPath)
+		}
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		return
+	}
+	mode := header.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	handleWarnErr(os.Chmod(entryPath, mode), "[%s] Cannot restore mode of '%s'", r.t.Name, entryPath)
+	handleWarnErr(os.Chtimes(entryPath, header.ModTime, header.ModTime), "[%s] Cannot restore modification time of '%s'", r.t.Name, entryPath)
+}
+
+// mkdirAll creates a directory and its missing parents, recording them as
+// created by the restore
+func (r *archiveRestorer) mkdirAll(dir string, perm os.FileMode) error {
+	var missing []string
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil || filepath.Dir(p) == p {
+			break
+		}
+		missing = append(missing, p)
+	}
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return err
+	}
+	for _, p := range missing {
+		r.createdDirs[p] = true
+	}
+	return nil
+}
+
+func restoreArchiveFile(content io.Reader, entryPath string) error {
+	file, err := os.OpenFile(entryPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, content); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// restoreEntry restores a file, a directory, a symlink or a hard link. Existing
+// files are skipped unless 'overwrite' is set or they come from an earlier
+// archive of the chain, and are removed rather than written through. Existing
+// directories likewise keep their metadata.
+func (r *archiveRestorer) restoreEntry(header *tar.Header, content io.Reader) error {
+	if !isRestorePathSelected(header.Name, r.opts.Paths) {
+		return nil
+	}
+	entryPath, root, ok := r.getEntryPath(header.Name)
+	if !ok {
+		log.Warnf("[%s] Skipping '%s', no target path has its prefix\n", r.t.Name, header.Name)
+		return nil
+	}
+	if r.hasSymlinkParent(root, entryPath) {
+		log.Warnf("[%s] Skipping '%s' located below a symlink\n", r.t.Name, entryPath)
+		return nil
+	}
+	existing, err := os.Lstat(entryPath)
+	if err == nil && !(header.Typeflag == tar.TypeDir && existing.IsDir()) {
+		if !r.opts.Overwrite && !r.restored[entryPath] {
+			log.Warnf("[%s] Skipping existing file '%s'\n", r.t.Name, entryPath)
+			return nil
+		}
+		if existing.IsDir() {
+			log.Warnf("[%s] Skipping '%s', a directory exists at its path\n", r.t.Name, entryPath)
+			return nil
+		}
+		if err := os.Remove(entryPath); err != nil {
+			return err
+		}
+	}
+	if err := r.mkdirAll(filepath.Dir(entryPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := r.mkdirAll(entryPath, 0700); err != nil {
+			return err
+		}
+		if !r.createdDirs[entryPath] && !r.opts.Overwrite {
+			log.Debugf("[%s] Keeping the metadata of existing directory '%s'\n", r.t.Name, entryPath)
+			return nil
+		}
+		// A later archive of the chain has the latest metadata of the directory
+		if i, ok := r.dirIndexes[entryPath]; ok {
+			r.dirs[i].header = header
+			return nil
+		}
+		r.dirIndexes[entryPath] = len(r.dirs)
+		r.dirs = append(r.dirs, restoredDir{path: entryPath, header: header})
+		return nil
+	case tar.TypeReg, tar.TypeRegA:
+		if err := restoreArchiveFile(content, entryPath); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, entryPath); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkPath, _, _ := r.getEntryPath(header.Linkname)
+		if !r.restored[linkPath] {
+			log.Warnf("[%s] Skipping hard link '%s' to '%s', which is not restored\n", r.t.Name, entryPath, linkPath)
+			return nil
+		}
+		if err := os.Link(linkPath, entryPath); err != nil {
+			return err
+		}
+	default:
+		log.Warnf("[%s] Skipping unsupported archive entry '%s'\n", r.t.Name, header.Name)
+		return nil
+	}
+	if header.Typeflag != tar.TypeLink {
+		r.applyMetadata(entryPath, header)
+	}
+	r.restored[entryPath] = true
+	r.count++
+	log.Debugf("[%s] Restored '%s'\n", r.t.Name, entryPath)
+	return nil
+}
+
+// finish applies the metadata of the restored directories, deepest first
+func (r *archiveRestorer) finish() {
+	for i := len(r.dirs) - 1; i >= 0; i-- {
+		r.applyMetadata(r.dirs[i].path, r.dirs[i].header)
+	}
+	r.dirs, r.dirIndexes = nil, map[string]int{}
+}
+
+// removeDeletedFiles removes the files deleted since the previous backup of an
+// incremental chain, deepest first. Files not restored by the chain are only
+// removed with 'overwrite'.
+func (r *archiveRestorer) removeDeletedFiles(manifest *BackupManifest) {
+	for i := len(manifest.Deleted) - 1; i >= 0; i-- {
+		name := manifest.Deleted[i]
+		if !isRestorePathSelected(name, r.opts.Paths) {
+			continue
+		}
+		entryPath, _, ok := r.getEntryPath(name)
+		if !ok || (!r.restored[entryPath] && !r.opts.Overwrite) {
+			continue
+		}
+		if err := os.Remove(entryPath); err != nil && !os.IsNotExist(err) {
+			handleWarnErr(err, "[%s] Cannot remove deleted file '%s'", r.t.Name, entryPath)
+			continue
+		}
+		delete(r.restored, entryPath)
+		log.Debugf("[%s] Removed deleted file '%s'\n", r.t.Name, entryPath)
+	}
+}
+
+// extractArchive restores the entries of an archive and returns how many were restored
+func extractArchive(format *ArchiveFormat, r io.Reader, restorer *archiveRestorer) (int, error) {
+	archiveReader, err := newArchiveReader(format, r)
+	if err != nil {
+		return 0, err
+	}
+	defer archiveReader.Close()
+
+	restoredBefore := restorer.count
+	var manifest *BackupManifest
+	for {
+		header, content, err := archiveReader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return restorer.count - restoredBefore, err
+		}
+		if header.Name == manifestEntryName {
+			if manifest, err = decodeBackupManifest(content); err != nil {
+				return restorer.count - restoredBefore, err
+			}
+			continue
+		}
+		if err := restorer.restoreEntry(header, content); err != nil {
+			return restorer.count - restoredBefore, err
+		}
+	}
+	if manifest != nil && !manifest.Full {
+		restorer.removeDeletedFiles(manifest)
+	}
+	return restorer.count - restoredBefore, nil
+}
+
+func decodeBackupManifest(r io.Reader) (*BackupManifest, error) {
+	manifest := &BackupManifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("cannot decode backup manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// openBackupItem returns the decrypted content of a backup, fetched from the
+// destination as it is read. The pipe returned must be closed once done.
+func openBackupItem(ctx context.Context, t *BackupTarget, d BackupDestination, item BackupItem, opts RestoreOptions) (io.Reader, *io.PipeReader, error) {
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(d.fetchBackup(ctx, item, pipeWriter))
+	}()
+	if !isArchiveEncrypted(item.Name) {
+		return pipeReader, pipeReader, nil
+	}
+	archive, err := newArchiveDecryptor(t, pipeReader, opts.IdentityFile)
+	if err != nil {
+		pipeReader.CloseWithError(err)
+		return nil, nil, fmt.Errorf("cannot decrypt backup: %w", err)
+	}
+	return archive, pipeReader, nil
+}
+
+// readBackupManifest returns the manifest of a backup, nil if it has none. The
+// manifest being the last entry, the whole archive is read.
+func readBackupManifest(ctx context.Context, t *BackupTarget, d BackupDestination, item BackupItem, opts RestoreOptions) (*BackupManifest, error) {
+	format, err := detectArchiveFormat(item.Name)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("%s Reading the manifest of '%s'\n", getDestLogPrefix(d), filepath.Base(item.Name))
+	archive, pipeReader, err := openBackupItem(ctx, t, d, item, opts)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readArchiveManifest(format, archive)
+	pipeReader.CloseWithError(err)
+	return manifest, err
+}
+
+func readArchiveManifest(format *ArchiveFormat, r io.Reader) (*BackupManifest, error) {
+	archiveReader, err := newArchiveReader(format, r)
+	if err != nil {
+		return nil, err
+	}
+	defer archiveReader.Close()
+	for {
+		header, content, err := archiveReader.next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if header.Name == manifestEntryName {
+			return decodeBackupManifest(content)
+		}
+	}
+}
+
+func restoreBackupItem(ctx context.Context, t *BackupTarget, d BackupDestination, item BackupItem, opts RestoreOptions, restorer *archiveRestorer) (int, error) {
+	detectFormat := detectArchiveFormat
+	if isRawCommandTarget(t) {
+		detectFormat = detectRawFormat
+	}
+	format, err := detectFormat(item.Name)
+	if err != nil {
+		return 0, err
+	}
+	archive, pipeReader, err := openBackupItem(ctx, t, d, item, opts)
+	if err != nil {
+		return 0, err
+	}
+	var restoredCount int
+	if isRawCommandTarget(t) {
+		restoredCount, err = restoreRawOutput(t, item, format, archive, restorer)
+	} else {
+		restoredCount, err = extractArchive(format, archive, restorer)
+	}
+	pipeReader.CloseWithError(err)
+	return restoredCount, err
+}
+
+func restoreBackup(ctx context.Context, t *BackupTarget, opts RestoreOptions) error {
+	destinations := getReadyDestinations(t)
+	if len(destinations) == 0 {
+		return fmt.Errorf("[%s] No initialized destination to restore from", t.Name)
+	}
+	d := destinations[0]
+	if len(opts.Destination) > 0 {
+		var err error
+		if d, err = findBackupDestination(t, opts.Destination); err != nil {
+			return err
+		}
+	}
+	items, err := selectBackupItems(ctx, d, opts.Backup, func(item BackupItem) (*BackupManifest, error) {
+		return readBackupManifest(ctx, t, d, item, opts)
+	})
+	if err != nil {
+		return err
+	}
+
+	restorer := newArchiveRestorer(t, opts)
+	defer restorer.finish()
+	if t.Config.Type == sqliteTargetType {
+		if err := checkSqliteRestoreDir(restorer.outputDir, getDatabaseDumpName(t)); err != nil {
+			return err
+		}
+	}
+	if t.Config.Type == repositoryTargetType {
+		item := items[len(items)-1]
+		log.Infof("%s Restoring snapshot '%s' into %s\n", getDestLogPrefix(d), item.Name, restorer.describeOutput())
+		restoredCount, err := restoreRepositorySnapshot(ctx, t, d, item, restorer)
+		if err != nil {
+			return err
+		}
+		log.Infof("%s Restored %d file(s) from '%s'\n", getDestLogPrefix(d), restoredCount, filepath.Base(item.Name))
+		return nil
+	}
+
+	for _, item := range items {
+		log.Infof("%s Restoring '%s' into %s\n", getDestLogPrefix(d), item.Name, restorer.describeOutput())
+		restoredCount, err := restoreBackupItem(ctx, t, d, item, opts, restorer)
+		if err != nil {
+			return err
+		}
+		log.Infof("%s Restored %d file(s) from '%s'\n", getDestLogPrefix(d), restoredCount, filepath.Base(item.Name))
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetRestoreEntryPath(t *testing.T) {
+	outputDir := filepath.FromSlash("/restore/out")
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"a.txt", "/restore/out/a.txt"},
+		{"dir/a.txt", "/restore/out/dir/a.txt"},
+		{"./dir/./a.txt", "/restore/out/dir/a.txt"},
+		{"/etc/passwd", "/restore/out/etc/passwd"},
+		{"../a.txt", "/restore/out/a.txt"},
+		{"../../../etc/passwd", "/restore/out/etc/passwd"},
+		{"dir/../../a.txt", "/restore/out/a.txt"},
+		{"dir/../other/a.txt", "/restore/out/other/a.txt"},
+		{"..", "/restore/out"},
+		{"", "/restore/out"},
+	}
+	for _, test := range tests {
+		entryPath := getRestoreEntryPath(outputDir, test.name)
+		if entryPath != filepath.FromSlash(test.path) {
+			t.Errorf("getRestoreEntryPath(%q) = %q, want %q", test.name, entryPath, test.path)
+		}
+		if !isPathWithin(outputDir, entryPath) {
+			t.Errorf("getRestoreEntryPath(%q) = %q escapes the output directory", test.name, entryPath)
+		}
+	}
+}
+
+func newTestRestorer(outputDir string) *archiveRestorer {
+	return newArchiveRestorer(&BackupTarget{Name: "test"}, RestoreOptions{OutputDir: outputDir})
+}
+
+func TestHasSymlinkParent(t *testing.T) {
+	root, err := ioutil.TempDir("", "autobackup_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "autobackup_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.MkdirAll(filepath.Join(root, "dir", "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("cannot create symlinks: %s", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "dir", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRestorer(root)
+	tests := []struct {
+		rel     string
+		symlink bool
+	}{
+		{"a.txt", false},
+		{"dir/a.txt", false},
+		{"dir/sub/a.txt", false},
+		{"missing/a.txt", false},
+		// The entry itself may be a symlink, only its parents matter
+		{"link", false},
+		{"link/a.txt", true},
+		{"link/sub/a.txt", true},
+		{"dir/link/a.txt", true},
+	}
+	for _, test := range tests {
+		entryPath := filepath.Join(root, filepath.FromSlash(test.rel))
+		if symlink := r.hasSymlinkParent(root, entryPath); symlink != test.symlink {
+			t.Errorf("hasSymlinkParent(%q) = %v, want %v", test.rel, symlink, test.symlink)
+		}
+	}
+}
+
+func TestRestoreEntryStaysInOutputDir(t *testing.T) {
+	parent, err := ioutil.TempDir("", "autobackup_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	outputDir := filepath.Join(parent, "out")
+	outside := filepath.Join(parent, "outside")
+	if err := os.MkdirAll(outside, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRestorer(outputDir)
+	restoreFile := func(name string) {
+		header := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600, Size: 4, ModTime: time.Now()}
+		if err := r.restoreEntry(header, strings.NewReader("data")); err != nil {
+			t.Fatalf("restoreEntry(%q): %s", name, err)
+		}
+	}
+	restoreFile("../outside/escaped.txt")
+	if _, err := os.Stat(filepath.Join(outside, "escaped.txt")); err == nil {
+		t.Error("an entry with '..' was restored outside of the output directory")
+	}
+	if _, err := os.Stat(filepath.Join(outputDir, "outside", "escaped.txt")); err != nil {
+		t.Errorf("an entry with '..' was not restored below the output directory: %s", err)
+	}
+
+	// A symlink entry followed by an entry below it must not write through it
+	link := &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside, ModTime: time.Now()}
+	if err := r.restoreEntry(link, nil); err != nil {
+		t.Skipf("cannot create symlinks: %s", err)
+	}
+	restoreFile("link/through.txt")
+	if _, err := os.Stat(filepath.Join(outside, "through.txt")); err == nil {
+		t.Error("an entry was written through a restored symlink")
+	}
+}
+
+func TestRestoreKeepsExistingDirectoryMetadata(t *testing.T) {
+	for _, overwrite := range []bool{false, true} {
+		outputDir, err := ioutil.TempDir("", "autobackup_test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(outputDir)
+		existing := filepath.Join(outputDir, "existing")
+		if err := os.Mkdir(existing, 0700); err != nil {
+			t.Fatal(err)
+		}
+		existingTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(existing, existingTime, existingTime); err != nil {
+			t.Fatal(err)
+		}
+
+		r := newArchiveRestorer(&BackupTarget{Name: "test"}, RestoreOptions{OutputDir: outputDir, Overwrite: overwrite})
+		archiveTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		for _, name := range []string{"existing", "created", "created/sub"} {
+			header := &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0750, ModTime: archiveTime}
+			if err := r.restoreEntry(header, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// A file restored in a directory first, creating it, before its own entry
+		file := &tar.Header{Name: "implicit/a.txt", Typeflag: tar.TypeReg, Mode: 0600, Size: 4, ModTime: archiveTime}
+		if err := r.restoreEntry(file, strings.NewReader("data")); err != nil {
+			t.Fatal(err)
+		}
+		dir := &tar.Header{Name: "implicit", Typeflag: tar.TypeDir, Mode: 0750, ModTime: archiveTime}
+		if err := r.restoreEntry(dir, nil); err != nil {
+			t.Fatal(err)
+		}
+		r.finish()
+
+		for _, name := range []string{"created", "created/sub", "implicit"} {
+			info, err := os.Stat(filepath.Join(outputDir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(archiveTime) || info.Mode().Perm() != 0750 {
+				t.Errorf("overwrite %v: directory %s created by the restore got %s %s", overwrite, name, info.Mode(), info.ModTime())
+			}
+		}
+		info, err := os.Stat(existing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := info.ModTime().Equal(existingTime) && info.Mode().Perm() == 0700
+		if kept == overwrite {
+			t.Errorf("overwrite %v: existing directory has %s %s", overwrite, info.Mode(), info.ModTime())
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+func (r *BackupRunResult) failedDestinations() int {
+	var failed int
+	for _, destResult := range r.Destinations {
+		if destResult.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// failed reports whether the run did not store the archive at every destination,
+// a run without any destination storing nothing
+func (r *BackupRunResult) failed() bool {
+	return r.Err != nil || len(r.Destinations) == 0 || r.failedDestinations() > 0
+}
+
+func (r *BackupRunResult) log() {
+	for _, destResult := range r.Destinations {
+		prefix := fmt.Sprintf("[%s][%s]", r.Target, destResult.Destination)
+		handleErr(destResult.Err, "%s Backup failed", prefix)
+		handleWarnErr(destResult.CleanErr, "%s Cleaning old backups failed", prefix)
+	}
+	if r.Err != nil {
+		log.Errorf("[%s] Backup failed after %s: %s\n", r.Target, r.Duration.Round(time.Millisecond), r.Err.Error())
+		return
+	}
+	if r.ChangedFiles > 0 {
+		log.Warnf("[%s] %d file(s) changed while being backed up, the backup may be inconsistent\n", r.Target, r.ChangedFiles)
+	}
+	log.Infof("[%s] Backup '%s' done in %s: %d file(s), %d skipped, %d bytes, %d/%d destination(s) succeeded\n",
+		r.Target, r.Archive, r.Duration.Round(time.Millisecond), r.Files, r.SkippedFiles, r.Bytes,
+		len(r.Destinations)-r.failedDestinations(), len(r.Destinations))
+}
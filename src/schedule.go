@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	"strings"
+	"time"
+)
+
+var frequencyDescriptors = map[string]string{
+	"hourly":   "@hourly",
+	"daily":    "@daily",
+	"weekly":   "@weekly",
+	"monthly":  "@monthly",
+	"yearly":   "@yearly",
+	"annually": "@yearly",
+}
+
+// parseFrequency translates a 'frequency' setting, either a named period such as
+// "daily" or a Go duration such as "6h", into a cron spec
+func parseFrequency(frequency string) (string, error) {
+	frequency = strings.ToLower(strings.TrimSpace(frequency))
+	if descriptor, ok := frequencyDescriptors[frequency]; ok {
+		return descriptor, nil
+	}
+	interval, err := time.ParseDuration(strings.TrimPrefix(frequency, "every "))
+	if err != nil {
+		return "", fmt.Errorf("invalid frequency '%s', expected hourly, daily, weekly, monthly, yearly or a duration such as '6h'", frequency)
+	}
+	if interval < time.Second {
+		return "", fmt.Errorf("invalid frequency '%s', must be at least one second", frequency)
+	}
+	return "@every " + interval.String(), nil
+}
+
+// getBackupTargetSchedule returns the cron spec of a target, built from exactly
+// one of its 'cron' or 'frequency' settings
+func getBackupTargetSchedule(t *BackupTarget) (string, error) {
+	hasCron := len(strings.TrimSpace(t.Config.Cron)) > 0
+	hasFrequency := len(strings.TrimSpace(t.Config.Frequency)) > 0
+	var spec string
+	switch {
+	case hasCron && hasFrequency:
+		return "", fmt.Errorf("both 'cron' and 'frequency' are set, only one of them is allowed")
+	case !hasCron && !hasFrequency:
+		return "", fmt.Errorf("missing schedule, either 'cron' or 'frequency' must be set")
+	case hasFrequency:
+		var err error
+		if spec, err = parseFrequency(t.Config.Frequency); err != nil {
+			return "", err
+		}
+	default:
+		spec = t.Config.Cron
+	}
+	if _, err := cron.ParseStandard(spec); err != nil {
+		return "", fmt.Errorf("invalid cron expression '%s' : %s", spec, err.Error())
+	}
+	return spec, nil
+}
+
+// isScheduledRunMissed reports whether a scheduled tick of the target passed
+// since its last successful run, or if it never succeeded at all
+func isScheduledRunMissed(t *BackupTarget, lastSuccess time.Time, now time.Time) (bool, error) {
+	if lastSuccess.IsZero() {
+		return true, nil
+	}
+	spec, err := getBackupTargetSchedule(t)
+	if err != nil {
+		return false, err
+	}
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return false, err
+	}
+	return !schedule.Next(lastSuccess).After(now), nil
+}
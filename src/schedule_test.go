@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseFrequency(t *testing.T) {
+	tests := []struct {
+		frequency string
+		spec      string
+	}{
+		{"hourly", "@hourly"},
+		{"Daily", "@daily"},
+		{" weekly ", "@weekly"},
+		{"monthly", "@monthly"},
+		{"annually", "@yearly"},
+		{"6h", "@every 6h0m0s"},
+		{"every 90m", "@every 1h30m0s"},
+		{"1s", "@every 1s"},
+	}
+	for _, test := range tests {
+		spec, err := parseFrequency(test.frequency)
+		if err != nil {
+			t.Errorf("parseFrequency(%q): %s", test.frequency, err)
+		} else if spec != test.spec {
+			t.Errorf("parseFrequency(%q) = %q, want %q", test.frequency, spec, test.spec)
+		}
+	}
+	for _, frequency := range []string{"", "often", "500ms", "-1h", "every"} {
+		if spec, err := parseFrequency(frequency); err == nil {
+			t.Errorf("parseFrequency(%q) = %q, want an error", frequency, spec)
+		}
+	}
+}
+
+func TestGetBackupTargetSchedule(t *testing.T) {
+	tests := []struct {
+		cron      string
+		frequency string
+		spec      string
+		fails     bool
+	}{
+		{cron: "0 3 * * *", spec: "0 3 * * *"},
+		{cron: "@daily", spec: "@daily"},
+		{frequency: "12h", spec: "@every 12h0m0s"},
+		{cron: "0 3 * * *", frequency: "daily", fails: true},
+		{fails: true},
+		{cron: "  ", frequency: " ", fails: true},
+		{cron: "61 * * * *", fails: true},
+		{cron: "0 3 * *", fails: true},
+		{frequency: "sometimes", fails: true},
+	}
+	for _, test := range tests {
+		target := &BackupTarget{Config: BackupTargetConfig{Cron: test.cron, Frequency: test.frequency}}
+		spec, err := getBackupTargetSchedule(target)
+		if test.fails {
+			if err == nil {
+				t.Errorf("cron %q, frequency %q: got %q, want an error", test.cron, test.frequency, spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cron %q, frequency %q: %s", test.cron, test.frequency, err)
+		} else if spec != test.spec {
+			t.Errorf("cron %q, frequency %q: got %q, want %q", test.cron, test.frequency, spec, test.spec)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// BackupSource is a root of the files of a target. Its files are stored under
+// Prefix in archives, so that several roots can share an archive.
+type BackupSource struct {
+	Path    string   `mapstructure:"path"`
+	Prefix  string   `mapstructure:"prefix"`
+	Include []string `mapstructure:"include"`
+	Exclude []string `mapstructure:"exclude"`
+	// origin is the configured path when Path is its copy in a snapshot
+	origin string
+}
+
+// originalPath returns the configured path of the source, wherever it is read from
+func (s *BackupSource) originalPath() string {
+	if len(s.origin) > 0 {
+		return s.origin
+	}
+	return s.Path
+}
+
+// stringToBackupSourceHook lets 'paths' entries be plain paths instead of tables
+func stringToBackupSourceHook(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+	if from.Kind() != reflect.String || to != reflect.TypeOf(BackupSource{}) {
+		return data, nil
+	}
+	return BackupSource{Path: data.(string)}, nil
+}
+
+// getBackupSources returns the roots of a target. The legacy 'path' setting is a
+// single root stored without prefix, while 'paths' roots default to a prefix
+// named after their last element.
+func getBackupSources(c BackupTargetConfig) []*BackupSource {
+	if isDatabaseTargetType(c.Type) || c.Type == commandTargetType {
+		// The dump or command output made on every run is the source of these targets
+		return nil
+	}
+	if len(c.Paths) == 0 {
+		if len(c.Path) == 0 {
+			return nil
+		}
+		return []*BackupSource{{Path: filepath.Clean(parseTilde(c.Path)), Include: c.Include, Exclude: c.Exclude}}
+	}
+	sources := make([]*BackupSource, 0, len(c.Paths))
+	for _, p := range c.Paths {
+		source := p
+		source.Path = filepath.Clean(parseTilde(source.Path))
+		source.Prefix = strings.Trim(path.Clean("/"+filepath.ToSlash(source.Prefix)), "/")
+		if len(source.Prefix) == 0 {
+			source.Prefix = filepath.Base(source.Path)
+		}
+		source.Include = append(append([]string{}, c.Include...), source.Include...)
+		source.Exclude = append(append([]string{}, c.Exclude...), source.Exclude...)
+		sources = append(sources, &source)
+	}
+	return sources
+}
+
+func isPathWithin(root string, p string) bool {
+	return p == root || strings.HasPrefix(p, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// getBackupSource returns the root a file was listed from
+func getBackupSource(t *BackupTarget, f string) *BackupSource {
+	for _, source := range t.Sources {
+		if isPathWithin(source.Path, f) {
+			return source
+		}
+	}
+	return nil
+}
+
+func validateBackupSources(t *BackupTarget) error {
+	if len(t.Config.Path) > 0 && len(t.Config.Paths) > 0 {
+		return fmt.Errorf("'path' and 'paths' cannot be combined")
+	}
+	if len(t.Sources) == 0 {
+		return fmt.Errorf("missing 'path'")
+	}
+	prefixes := make(map[string]string)
+	for i, source := range t.Sources {
+		if len(t.Config.Paths) > 0 && source.Prefix == "." {
+			return fmt.Errorf("invalid prefix for path '%s'", source.Path)
+		}
+		if other, ok := prefixes[source.Prefix]; ok {
+			return fmt.Errorf("paths '%s' and '%s' have the same prefix '%s', set a distinct 'prefix'", other, source.Path, source.Prefix)
+		}
+		prefixes[source.Prefix] = source.Path
+		for _, other := range t.Sources[:i] {
+			if isPathWithin(other.Path, source.Path) || isPathWithin(source.Path, other.Path) {
+				return fmt.Errorf("paths '%s' and '%s' overlap", other.Path, source.Path)
+			}
+		}
+	}
+	return nil
+}
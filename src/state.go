@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type DestinationState struct {
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+type BackupTargetState struct {
+	LastAttempt  time.Time                    `json:"last_attempt"`
+	LastSuccess  time.Time                    `json:"last_success"`
+	LastArchive  string                       `json:"last_archive,omitempty"`
+	LastError    string                       `json:"last_error,omitempty"`
+	Destinations map[string]*DestinationState `json:"destinations"`
+}
+
+// StateStore is the run history of every backup target, persisted as a JSON file
+type StateStore struct {
+	path    string
+	mutex   sync.Mutex
+	Targets map[string]*BackupTargetState `json:"targets"`
+}
+
+func getDefaultStateFile() string {
+	if stateHome := os.Getenv("XDG_STATE_HOME"); len(stateHome) > 0 {
+		return filepath.Join(stateHome, "autobackup", "state.json")
+	}
+	return parseTilde("~/.local/state/autobackup/state.json")
+}
+
+func loadStateStore(path string) (*StateStore, error) {
+	store := &StateStore{path: path, Targets: map[string]*BackupTargetState{}}
+	targets, err := readStateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if targets != nil {
+		store.Targets = targets
+	}
+	return store, nil
+}
+
+// readStateFile returns the targets of a state file, nil if it does not exist
+func readStateFile(path string) (map[string]*BackupTargetState, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read state file: %w", err)
+	}
+	state := struct {
+		Targets map[string]*BackupTargetState `json:"targets"`
+	}{}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("cannot decode state file %s: %w", path, err)
+	}
+	if state.Targets == nil {
+		state.Targets = map[string]*BackupTargetState{}
+	}
+	return state.Targets, nil
+}
+
+// lockStateFile takes an exclusive lock on the state file, shared by the daemon
+// and the commands run next to it, returning the function releasing it
+func lockStateFile(path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open state lock file: %w", err)
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("cannot lock state file: %w", err)
+	}
+	return func() {
+		unlockFile(lock)
+		lock.Close()
+	}, nil
+}
+
+// save writes the state to a temporary file renamed over the previous one, so
+// that a crash never leaves a truncated state file
+func (s *StateStore) save() error {
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.path), ".state_*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), s.path)
+}
+
+// getLastSuccess returns the last successful run of a target, recorded by this
+// process or another one. The state file being replaced by a rename, it is read
+// without the lock.
+func (s *StateStore) getLastSuccess(name string) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	targets, err := readStateFile(s.path)
+	if !handleWarnErr(err, "[%s] Cannot read state file, using the state loaded before", name) && targets != nil {
+		s.Targets = targets
+	}
+	if targetState, ok := s.Targets[name]; ok {
+		return targetState.LastSuccess
+	}
+	return time.Time{}
+}
+
+// record updates the state of the target of a run. The state file is read again
+// under a lock first, so that the runs recorded by another process since it was
+// loaded are kept.
+func (s *StateStore) record(result *BackupRunResult) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	unlock, err := lockStateFile(s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	targets, err := readStateFile(s.path)
+	if err != nil {
+		return err
+	}
+	if targets != nil {
+		s.Targets = targets
+	}
+
+	targetState, ok := s.Targets[result.Target]
+	if !ok {
+		targetState = &BackupTargetState{}
+		s.Targets[result.Target] = targetState
+	}
+	if targetState.Destinations == nil {
+		targetState.Destinations = map[string]*DestinationState{}
+	}
+	targetState.LastAttempt = result.Started
+	targetState.LastError = ""
+	if result.failed() {
+		if result.Err != nil {
+			targetState.LastError = result.Err.Error()
+		} else {
+			targetState.LastError = fmt.Sprintf("backup failed at %d of %d destination(s)", result.failedDestinations(), len(result.Destinations))
+		}
+	} else {
+		targetState.LastSuccess = result.Started
+		targetState.LastArchive = result.Archive
+	}
+	for _, destResult := range result.Destinations {
+		destState, ok := targetState.Destinations[destResult.Destination]
+		if !ok {
+			destState = &DestinationState{}
+			targetState.Destinations[destResult.Destination] = destState
+		}
+		destState.LastAttempt = result.Started
+		destState.LastError = ""
+		if destResult.Err != nil {
+			destState.LastError = destResult.Err.Error()
+		} else {
+			destState.LastSuccess = result.Started
+		}
+	}
+	return s.save()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRunResult(target string, started time.Time) *BackupRunResult {
+	return &BackupRunResult{
+		Target:       target,
+		Archive:      target + ".tar.gz",
+		Started:      started,
+		Destinations: []DestinationRunResult{{Destination: "local"}},
+	}
+}
+
+func TestStateStoreKeepsRecordsOfOtherProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobackup_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+
+	// The daemon and a 'run' command both load the state before either records
+	daemon, err := loadStateStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, err := loadStateStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	if err := command.record(newTestRunResult("docs", started)); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.record(newTestRunResult("photos", started.Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := loadStateStore(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if success := stored.getLastSuccess("docs"); !success.Equal(started) {
+		t.Errorf("the run recorded by the command was lost, last success %s", success)
+	}
+	if success := stored.getLastSuccess("photos"); !success.Equal(started.Add(time.Hour)) {
+		t.Errorf("the run recorded by the daemon was lost, last success %s", success)
+	}
+	// The daemon sees the runs recorded by the command since it started
+	if success := daemon.getLastSuccess("docs"); !success.Equal(started) {
+		t.Errorf("the daemon does not see the run of the command, last success %s", success)
+	}
+}
+
+func TestStateStoreRecordsFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "autobackup_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := loadStateStore(filepath.Join(dir, "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	if err := store.record(newTestRunResult("docs", started)); err != nil {
+		t.Fatal(err)
+	}
+	// A run without destination fails, keeping the last success
+	if err := store.record(&BackupRunResult{Target: "docs", Started: started.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	targetState := store.Targets["docs"]
+	if !targetState.LastSuccess.Equal(started) || targetState.LastArchive != "docs.tar.gz" {
+		t.Errorf("a failed run changed the last success to %s (%s)", targetState.LastSuccess, targetState.LastArchive)
+	}
+	if len(targetState.LastError) == 0 || !targetState.LastAttempt.Equal(started.Add(time.Hour)) {
+		t.Errorf("the failed run was not recorded: %+v", targetState)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+var errDestinationStoppedReading = errors.New("destination stopped reading the archive stream")
+
+// fanOutWriter copies every write to all the destination pipes. A pipe whose
+// destination failed is dropped instead of failing the other destinations.
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+	errs    []error
+	written int64
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	var alive int
+	for i, w := range f.writers {
+		if f.errs[i] != nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.errs[i] = err
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, fmt.Errorf("every destination failed")
+	}
+	f.written += int64(len(p))
+	return len(p), nil
+}
+
+// streamBackupTarget builds the archive while uploading it concurrently to every
+// destination, without writing it to a temporary file
+func streamBackupTarget(ctx context.Context, t *BackupTarget, result *BackupRunResult) error {
+	destinations := getReadyDestinations(t)
+	if len(destinations) == 0 {
+		return fmt.Errorf("no destination to stream the archive to")
+	}
+	archiveName := getArchiveName(t, result.Started)
+	result.Archive = archiveName
+	fanOut := &fanOutWriter{
+		writers: make([]*io.PipeWriter, len(destinations)),
+		errs:    make([]error, len(destinations)),
+	}
+	destResults := make([]DestinationRunResult, len(destinations))
+
+	var wg sync.WaitGroup
+	for i, d := range destinations {
+		pipeReader, pipeWriter := io.Pipe()
+		fanOut.writers[i] = pipeWriter
+		wg.Add(1)
+		go func(destResult *DestinationRunResult, d BackupDestination, pipeReader *io.PipeReader) {
+			defer wg.Done()
+			destResult.Destination = d.getName()
+			started := time.Now()
+			destResult.Err = d.runBackup(ctx, archiveName, pipeReader, -1)
+			if destResult.Err != nil {
+				pipeReader.CloseWithError(destResult.Err)
+			} else {
+				pipeReader.CloseWithError(errDestinationStoppedReading)
+				if t.Config.KeepOnly > 0 {
+					destResult.CleanErr = d.cleanOldBackups(ctx)
+				}
+			}
+			destResult.Duration = time.Since(started)
+		}(&destResults[i], d, pipeReader)
+	}
+
+	log.Infof("[%s] Streaming archive '%s' to %d destination(s)\n", t.Name, archiveName, len(destinations))
+	archiveErr := writeArchive(ctx, t, fanOut, result)
+	for _, pipeWriter := range fanOut.writers {
+		// A nil error is seen as the end of the archive by the destinations
+		pipeWriter.CloseWithError(archiveErr)
+	}
+	wg.Wait()
+
+	result.Bytes = fanOut.written
+	result.Destinations = append(result.Destinations, destResults...)
+	return archiveErr
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const gitBundleExt = ".bundle"
+
+// vcsMarkers are the metadata directories of version control systems, skipped
+// with 'exclude_vcs'
+var vcsMarkers = []string{".git", ".hg", ".svn", ".bzr", "_darcs", "CVS"}
+
+func isVcsMarker(name string) bool {
+	return stringInSlice(name, vcsMarkers)
+}
+
+// isBareGitRepository reports whether dir looks like a git directory without a
+// working tree
+func isBareGitRepository(dir string) bool {
+	if info, err := os.Stat(filepath.Join(dir, "HEAD")); err != nil || info.IsDir() {
+		return false
+	}
+	for _, subDir := range []string{"objects", "refs"} {
+		if info, err := os.Stat(filepath.Join(dir, subDir)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// getGitBundleEntryName names the bundle of a git directory after it, so that
+// 'project/.git' is backed up as 'project/.git.bundle'
+func getGitBundleEntryName(t *BackupTarget, gitDir string) string {
+	name := getArchiveEntryName(t, gitDir)
+	if len(name) == 0 {
+		name = filepath.Base(gitDir)
+	}
+	return name + gitBundleExt
+}
+
+// createGitBundle writes a bundle of every ref of a repository to a file of the
+// temporary working directory of the target, which the caller removes
+func createGitBundle(ctx context.Context, t *BackupTarget, gitDir string) (string, error) {
+	// Streaming runs have no working directory until one is needed
+	if err := createBackupTargetTempWorkdir(t); err != nil {
+		return "", err
+	}
+	bundleFile, err := ioutil.TempFile(t.TmpWorkdir, "bundle_*"+gitBundleExt)
+	if err != nil {
+		return "", err
+	}
+	bundleFile.Close()
+	output, err := exec.CommandContext(ctx, "git", "--git-dir="+gitDir, "bundle", "create", bundleFile.Name(), "--all").CombinedOutput()
+	if err != nil {
+		os.Remove(bundleFile.Name())
+		return "", fmt.Errorf("git bundle of %s failed: %w: %s", gitDir, err, strings.TrimSpace(string(output)))
+	}
+	return bundleFile.Name(), nil
+}
+
+// addGitBundles bundles every git repository found in the target and passes the
+// bundles to add. A repository that cannot be bundled, an empty one for instance,
+// is skipped with a warning.
+func addGitBundles(ctx context.Context, t *BackupTarget, result *BackupRunResult, add func(bundlePath string, name string) (bool, error)) error {
+	for _, gitDir := range t.GitRepositories {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		bundlePath, err := createGitBundle(ctx, t, gitDir)
+		if err != nil {
+			log.Warnf("[%s] Skipping git repository: %s\n", t.Name, err.Error())
+			result.SkippedFiles++
+			continue
+		}
+		added, err := add(bundlePath, getGitBundleEntryName(t, gitDir))
+		os.Remove(bundlePath)
+		if err != nil {
+			return err
+		}
+		if added {
+			result.Files++
+		} else {
+			result.SkippedFiles++
+		}
+	}
+	return nil
+}
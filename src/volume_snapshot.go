@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	btrfsSnapshotType   = "btrfs"
+	zfsSnapshotType     = "zfs"
+	commandSnapshotType = "command"
+)
+
+const defaultSnapshotTimeout = 5 * time.Minute
+
+// VolumeSnapshotConfig describes the snapshot the files of a target are read
+// from, so that the backup does not mix files from different moments
+type VolumeSnapshotConfig struct {
+	Type string `mapstructure:"type"`
+	// Volume is the btrfs subvolume, the mount point of the ZFS dataset or the
+	// volume snapshotted by the commands. It defaults to the target path, or to
+	// the mount point of the dataset for ZFS.
+	Volume string `mapstructure:"volume"`
+	// Directory is where btrfs snapshots are created, next to the subvolume by default
+	Directory string `mapstructure:"directory"`
+	Dataset   string `mapstructure:"dataset"`
+	// Create, Mount and Destroy are the shell commands of 'command' snapshots.
+	// Mount is optional if Create makes the snapshot readable at MountPath.
+	Create  string `mapstructure:"create"`
+	Mount   string `mapstructure:"mount"`
+	Destroy string `mapstructure:"destroy"`
+	// MountPath is where the snapshot can be read, a temporary directory by default
+	MountPath string        `mapstructure:"mount_path"`
+	Timeout   time.Duration `mapstructure:"timeout"`
+}
+
+func (c VolumeSnapshotConfig) enabled() bool {
+	return len(c.Type) > 0
+}
+
+func (c VolumeSnapshotConfig) getTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultSnapshotTimeout
+}
+
+// getSnapshotVolume returns the configured volume, or the path of a single
+// path target. It is empty for ZFS snapshots until the dataset is queried.
+func getSnapshotVolume(t *BackupTarget) string {
+	if len(t.Config.Snapshot.Volume) > 0 {
+		return filepath.Clean(parseTilde(t.Config.Snapshot.Volume))
+	}
+	if len(t.Sources) == 1 && t.Config.Snapshot.Type != zfsSnapshotType {
+		return t.Sources[0].Path
+	}
+	return ""
+}
+
+func validateVolumeSnapshot(t *BackupTarget) error {
+	c := t.Config.Snapshot
+	if isDatabaseTargetType(t.Config.Type) || t.Config.Type == commandTargetType {
+		return fmt.Errorf("%s targets do not support 'snapshot'", t.Config.Type)
+	}
+	var binary string
+	switch c.Type {
+	case btrfsSnapshotType:
+		binary = "btrfs"
+	case zfsSnapshotType:
+		binary = "zfs"
+		if len(c.Dataset) == 0 {
+			return fmt.Errorf("missing 'snapshot.dataset'")
+		}
+	case commandSnapshotType:
+		if len(strings.TrimSpace(c.Create)) == 0 || len(strings.TrimSpace(c.Destroy)) == 0 {
+			return fmt.Errorf("'command' snapshots require 'snapshot.create' and 'snapshot.destroy'")
+		}
+		if len(c.Mount) == 0 && len(c.MountPath) == 0 {
+			return fmt.Errorf("'command' snapshots require 'snapshot.mount' or 'snapshot.mount_path'")
+		}
+	default:
+		return fmt.Errorf("unknown snapshot type '%s'", c.Type)
+	}
+	if len(binary) > 0 {
+		if _, err := exec.LookPath(binary); err != nil {
+			return fmt.Errorf("cannot find the snapshot program: %w", err)
+		}
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("'snapshot.timeout' cannot be negative")
+	}
+	volume := getSnapshotVolume(t)
+	if len(volume) == 0 && c.Type != zfsSnapshotType {
+		return fmt.Errorf("missing 'snapshot.volume'")
+	}
+	if len(volume) > 0 {
+		for _, source := range t.Sources {
+			if !isPathWithin(volume, source.Path) {
+				return fmt.Errorf("path '%s' is not in the snapshot volume '%s'", source.Path, volume)
+			}
+		}
+	}
+	return nil
+}
+
+// volumeSnapshot is a snapshot created for a run, readable at mountPath
+type volumeSnapshot struct {
+	t         *BackupTarget
+	name      string
+	volume    string
+	mountPath string
+	destroy   func(ctx context.Context) error
+	// tmpMountPath is set when mountPath is a directory created for the run
+	tmpMountPath bool
+}
+
+// runSnapshotCommand runs a snapshot program or a snapshot shell command,
+// returning its standard output
+func runSnapshotCommand(ctx context.Context, t *BackupTarget, cmd *exec.Cmd, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.Config.Snapshot.getTimeout())
+	defer cancel()
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := runSourceCommand(ctx, t, cmd, name)
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%s timed out after %s", name, t.Config.Snapshot.getTimeout())
+	}
+	return strings.TrimSpace(stdout.String()), err
+}
+
+func (s *volumeSnapshot) newShellCommand(command string) *exec.Cmd {
+	cmd := newShellCommand(command)
+	cmd.Env = append(os.Environ(),
+		"AUTOBACKUP_TARGET="+s.t.Name,
+		"AUTOBACKUP_SNAPSHOT_NAME="+s.name,
+		"AUTOBACKUP_SNAPSHOT_VOLUME="+s.volume,
+		"AUTOBACKUP_SNAPSHOT_MOUNT="+s.mountPath,
+	)
+	return cmd
+}
+
+func (s *volumeSnapshot) createBtrfs(ctx context.Context) error {
+	dir := filepath.Dir(s.volume)
+	if len(s.t.Config.Snapshot.Directory) > 0 {
+		dir = filepath.Clean(parseTilde(s.t.Config.Snapshot.Directory))
+	}
+	s.mountPath = filepath.Join(dir, s.name)
+	if _, err := runSnapshotCommand(ctx, s.t, newCommand("btrfs", "subvolume", "snapshot", "-r", s.volume, s.mountPath), "btrfs"); err != nil {
+		return err
+	}
+	s.destroy = func(ctx context.Context) error {
+		_, err := runSnapshotCommand(ctx, s.t, newCommand("btrfs", "subvolume", "delete", s.mountPath), "btrfs")
+		return err
+	}
+	return nil
+}
+
+func (s *volumeSnapshot) createZfs(ctx context.Context) error {
+	dataset := s.t.Config.Snapshot.Dataset
+	if len(s.volume) == 0 {
+		mountPoint, err := runSnapshotCommand(ctx, s.t, newCommand("zfs", "get", "-H", "-o", "value", "mountpoint", dataset), "zfs")
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(mountPoint) {
+			return fmt.Errorf("dataset '%s' is not mounted", dataset)
+		}
+		s.volume = mountPoint
+	}
+	snapshotName := dataset + "@" + s.name
+	if _, err := runSnapshotCommand(ctx, s.t, newCommand("zfs", "snapshot", snapshotName), "zfs"); err != nil {
+		return err
+	}
+	s.destroy = func(ctx context.Context) error {
+		_, err := runSnapshotCommand(ctx, s.t, newCommand("zfs", "destroy", snapshotName), "zfs")
+		return err
+	}
+	// ZFS mounts snapshots on access below the hidden .zfs directory of the dataset
+	s.mountPath = filepath.Join(s.volume, ".zfs", "snapshot", s.name)
+	return nil
+}
+
+func (s *volumeSnapshot) createWithCommands(ctx context.Context) error {
+	c := s.t.Config.Snapshot
+	s.mountPath = filepath.Clean(parseTilde(c.MountPath))
+	if len(c.MountPath) == 0 {
+		// Not in the working directory, whose removal would delete the files of
+		// a snapshot left mounted
+		dir, err := ioutil.TempDir(os.TempDir(), "autobackup_"+s.t.Name+"_snapshot_")
+		if err != nil {
+			return fmt.Errorf("cannot create snapshot mount point: %w", err)
+		}
+		s.mountPath, s.tmpMountPath = dir, true
+	}
+	if _, err := runSnapshotCommand(ctx, s.t, s.newShellCommand(c.Create), "snapshot create command"); err != nil {
+		return err
+	}
+	s.destroy = func(ctx context.Context) error {
+		_, err := runSnapshotCommand(ctx, s.t, s.newShellCommand(c.Destroy), "snapshot destroy command")
+		return err
+	}
+	if len(c.Mount) > 0 {
+		if _, err := runSnapshotCommand(ctx, s.t, s.newShellCommand(c.Mount), "snapshot mount command"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createVolumeSnapshot creates the snapshot of a target. The snapshot must be
+// removed even if an error is returned, since it may be partially created.
+func createVolumeSnapshot(ctx context.Context, t *BackupTarget, started time.Time) (*volumeSnapshot, error) {
+	s := &volumeSnapshot{
+		t:      t,
+		name:   "autobackup_" + t.Name + "_" + started.Format("20060102150405"),
+		volume: getSnapshotVolume(t),
+	}
+	log.Infof("[%s] Creating %s snapshot '%s'\n", t.Name, t.Config.Snapshot.Type, s.name)
+	var err error
+	switch t.Config.Snapshot.Type {
+	case btrfsSnapshotType:
+		err = s.createBtrfs(ctx)
+	case zfsSnapshotType:
+		err = s.createZfs(ctx)
+	case commandSnapshotType:
+		err = s.createWithCommands(ctx)
+	}
+	if err != nil {
+		return s, err
+	}
+	if _, err := os.Stat(s.mountPath); err != nil {
+		return s, fmt.Errorf("cannot read snapshot: %w", err)
+	}
+	log.Debugf("[%s] Snapshot '%s' readable at %s\n", t.Name, s.name, s.mountPath)
+	return s, nil
+}
+
+// getSources returns the sources of the target read from the snapshot. They
+// keep their prefix so that entries are named as without snapshot.
+func (s *volumeSnapshot) getSources(sources []*BackupSource) ([]*BackupSource, error) {
+	snapshotSources := make([]*BackupSource, 0, len(sources))
+	for _, source := range sources {
+		rel, err := filepath.Rel(s.volume, source.Path)
+		if err != nil || !isPathWithin(s.volume, source.Path) {
+			return nil, fmt.Errorf("path '%s' is not in the snapshot volume '%s'", source.Path, s.volume)
+		}
+		snapshotSource := *source
+		snapshotSource.Path = filepath.Join(s.mountPath, rel)
+		snapshotSource.origin = source.Path
+		snapshotSources = append(snapshotSources, &snapshotSource)
+	}
+	return snapshotSources, nil
+}
+
+// remove tears the snapshot down, even when the run was cancelled. If it fails,
+// the snapshot may still be mounted, so its mount point and the working
+// directory of the run are left for the user to clean up.
+func (s *volumeSnapshot) remove() {
+	if s.destroy != nil {
+		err := s.destroy(context.Background())
+		if handleErr(err, "[%s] Cannot remove snapshot '%s'", s.t.Name, s.name) {
+			keepBackupTargetTempWorkdir(s.t)
+			if s.tmpMountPath {
+				log.Warnf("[%s] Keeping snapshot mount point %s\n", s.t.Name, s.mountPath)
+			}
+			return
+		}
+		log.Infof("[%s] Removed snapshot '%s'\n", s.t.Name, s.name)
+	}
+	if s.tmpMountPath {
+		// Only removes an empty directory, never the files of a mounted snapshot
+		handleWarnErr(os.Remove(s.mountPath), "[%s] Cannot remove snapshot mount point", s.t.Name)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func getXattrs(_ string) (map[string]string, error) {
+	return nil, fmt.Errorf("extended attributes are only supported on linux")
+}
+
+func setXattr(_ string, _ string, _ string) error {
+	return fmt.Errorf("extended attributes are only supported on linux")
+}